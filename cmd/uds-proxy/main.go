@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"log"
 	"os"
 
 	"github.com/schnoddelbotz/uds-proxy/proxy"
@@ -9,30 +12,130 @@ import (
 
 func main() {
 	var args proxy.Settings
+	var configFile string
+	defaults := proxy.DefaultSettings()
 
-	if os.Getuid() == 0 {
-		println("uds-proxy is refusing to run as root user")
-		os.Exit(1)
+	// `uds-proxy config print [flags]` dumps the resolved configuration
+	cmdArgs := os.Args[1:]
+	printConfig := len(cmdArgs) >= 2 && cmdArgs[0] == "config" && cmdArgs[1] == "print"
+	if printConfig {
+		cmdArgs = cmdArgs[2:]
 	}
 
-	flag.BoolVar(&args.NoLogTimeStamps, "no-log-timestamps", false, "disable timestamps in log messages")
-	flag.BoolVar(&args.NoAccessLog, "no-access-log", false, "disable proxy access logging")
+	flag.StringVar(&configFile, "config", os.Getenv(proxy.EnvPrefix+"CONFIG"), "configuration file (.json, .yaml or .toml)")
+
+	flag.BoolVar(&args.NoLogTimeStamps, "no-log-timestamps", defaults.NoLogTimeStamps, "disable timestamps in log messages")
+	flag.BoolVar(&args.NoAccessLog, "no-access-log", defaults.NoAccessLog, "disable proxy access logging")
+	flag.BoolVar(&args.MetricsPeerUID, "metrics-peer-uid", defaults.MetricsPeerUID, "count requests per client uid and route (udsproxy_peer_requests_total)")
 	flag.BoolVar(&args.PrintVersion, "version", false, "print uds-proxy version")
-	flag.BoolVar(&args.RemoteHTTPS, "remote-https", false, "remote uses https://")
+	flag.BoolVar(&args.RemoteHTTPS, "remote-https", defaults.RemoteHTTPS, "remote uses https://")
+	flag.BoolVar(&args.SocketCreateDir, "socket-create-dir", defaults.SocketCreateDir, "create missing parent directories of -socket")
+	flag.BoolVar(&args.DNSCache, "dns-cache", defaults.DNSCache, "resolve backend hosts via -dns-servers, caching answers for their TTL")
+	flag.BoolVar(&args.LogHostOverrides, "log-host-overrides", defaults.LogHostOverrides, "log connections redirected by host-overrides (config file)")
+	flag.BoolVar(&args.SocketH2C, "socket-h2c", defaults.SocketH2C, "accept HTTP/2 with prior knowledge (h2c, e.g. gRPC clients) on -socket and other listeners")
+
+	flag.IntVar(&args.MaxConnsPerHost, "max-conns-per-host", defaults.MaxConnsPerHost, "maximum number of connections per backend host")
+	flag.IntVar(&args.MaxIdleConns, "max-idle-conns", defaults.MaxIdleConns, "maximum number of idle HTTP(S) connections")
+	flag.IntVar(&args.MaxIdleConnsPerHost, "max-idle-conns-per-host", defaults.MaxIdleConnsPerHost, "maximum number of idle conns per backend")
+	flag.IntVar(&args.ClientTimeout, "client-timeout", defaults.ClientTimeout, "http client connection timeout [ms] for proxy requests")
+	flag.IntVar(&args.IdleConnTimeout, "idle-timeout", defaults.IdleConnTimeout, "connection timeout [ms] for idle backend connections")
+	flag.IntVar(&args.SocketReadTimeout, "socket-read-timeout", defaults.SocketReadTimeout, "read timeout [ms] for -socket")
+	flag.IntVar(&args.SocketWriteTimeout, "socket-write-timeout", defaults.SocketWriteTimeout, "write timeout [ms] for -socket")
+	flag.IntVar(&args.ShutdownTimeout, "shutdown-timeout", defaults.ShutdownTimeout, "time [ms] in-flight requests may take to complete on shutdown")
+	flag.IntVar(&args.H2MaxConcurrentStreams, "h2-max-concurrent-streams", defaults.H2MaxConcurrentStreams, "maximum number of HTTP/2 requests in flight per backend, 0 for no limit")
+	flag.IntVar(&args.H2PingInterval, "h2-ping-interval", defaults.H2PingInterval, "ping HTTP/2 backend connections idle for this long [ms], 0 disables health checks")
+	flag.IntVar(&args.H2PingTimeout, "h2-ping-timeout", defaults.H2PingTimeout, "close HTTP/2 backend connections not answering a ping within [ms]")
+	flag.IntVar(&args.Retries, "retries", defaults.Retries, "retry requests failing without response this often: idempotent ones, others if not sent yet")
+	flag.IntVar(&args.RetryBackoff, "retry-backoff", defaults.RetryBackoff, "backoff [ms] before the first retry, doubled for each further one and jittered")
+	flag.IntVar(&args.RetryBufferSize, "retry-buffer-size", defaults.RetryBufferSize, "maximum request body size [bytes] buffered to retry idempotent requests")
+	flag.IntVar(&args.BreakerFailures, "breaker-failures", defaults.BreakerFailures, "open an upstream's circuit breaker after this many consecutive failures, 0 disables")
+	flag.IntVar(&args.BreakerErrorRate, "breaker-error-rate", defaults.BreakerErrorRate, "open an upstream's circuit breaker if this percentage of requests fails, 0 disables")
+	flag.IntVar(&args.BreakerTimeoutRate, "breaker-timeout-rate", defaults.BreakerTimeoutRate, "open an upstream's circuit breaker if this percentage of requests times out, 0 disables")
+	flag.IntVar(&args.BreakerMinRequests, "breaker-min-requests", defaults.BreakerMinRequests, "requests within -breaker-window before rates may open a circuit breaker")
+	flag.IntVar(&args.BreakerWindow, "breaker-window", defaults.BreakerWindow, "time [ms] over which circuit breakers compute error and timeout rates")
+	flag.IntVar(&args.BreakerOpenTime, "breaker-open-time", defaults.BreakerOpenTime, "time [ms] an open circuit breaker fails requests before letting a probe request through")
+	flag.IntVar(&args.HedgePercentile, "hedge-percentile", defaults.HedgePercentile, "hedge GET requests not answered within this percentile of latencies by a second attempt, 0 disables")
+	flag.IntVar(&args.HedgeBudget, "hedge-budget", defaults.HedgeBudget, "maximum hedges sent, as percentage of requests")
+	flag.IntVar(&args.HedgeMinDelay, "hedge-min-delay", defaults.HedgeMinDelay, "minimum time [ms] to wait for a response before hedging a request")
+	flag.StringVar(&args.RateLimit, "rate-limit", defaults.RateLimit, "limit requests per route, e.g. 10/s, 600/m or 5000/h; empty disables")
+	flag.IntVar(&args.RateLimitBurst, "rate-limit-burst", defaults.RateLimitBurst, "requests that may exceed -rate-limit in a burst")
+	flag.StringVar(&args.RateLimitKey, "rate-limit-key", defaults.RateLimitKey, "limit requests per peer (uid) or per value of a header (header:<name>) rather than per route")
+	flag.StringVar(&args.RateLimitMode, "rate-limit-mode", defaults.RateLimitMode, "requests exceeding -rate-limit wait (queue) or are answered with 429 (reject)")
+	flag.IntVar(&args.RateLimitQueueTimeout, "rate-limit-queue-timeout", defaults.RateLimitQueueTimeout, "maximum time [ms] requests wait for -rate-limit in queue mode before getting 429")
+	flag.IntVar(&args.RateLimitMaxPause, "rate-limit-max-pause", defaults.RateLimitMaxPause, "maximum time [ms] an upstream's Retry-After may pause -rate-limit; 0 ignores Retry-After")
+	flag.IntVar(&args.MaxConcurrency, "max-concurrency", defaults.MaxConcurrency, "maximum concurrent requests per upstream, the initial one in adaptive modes; 0 disables")
+	flag.IntVar(&args.ConcurrencyQueue, "concurrency-queue", defaults.ConcurrencyQueue, "maximum requests waiting for -max-concurrency per upstream before getting 503")
+	flag.IntVar(&args.ConcurrencyTimeout, "concurrency-timeout", defaults.ConcurrencyTimeout, "maximum time [ms] requests wait for -max-concurrency before getting 503")
+	flag.StringVar(&args.ConcurrencyMode, "concurrency-mode", defaults.ConcurrencyMode, "keep -max-concurrency fixed, or adapt it to failures (aimd) or latencies (gradient)")
+	flag.IntVar(&args.DNSStaleTTL, "dns-stale-ttl", defaults.DNSStaleTTL, "time [ms] -dns-cache may use expired answers while DNS servers fail")
+	flag.IntVar(&args.FlushInterval, "flush-interval", defaults.FlushInterval, "flush interval [ms] for proxied responses, -1 flushes every write")
+
+	flag.StringVar(&args.PidFile, "pid-file", defaults.PidFile, "pid file to use, none if empty")
+	flag.StringVar(&args.SocketPath, "socket", defaults.SocketPath, "path of socket to create, @name for an abstract socket (Linux)")
+	flag.StringVar(&args.SocketMode, "socket-mode", defaults.SocketMode, "octal permissions of -socket, e.g. 0660 (default: by umask)")
+	flag.StringVar(&args.SocketGroup, "socket-group", defaults.SocketGroup, "group name or id owning -socket")
+	flag.StringVar(&args.ListenTCP, "listen-tcp", defaults.ListenTCP, "loopback address for HTTP proxy clients that cannot use -socket, e.g. 127.0.0.1:3128")
+	flag.StringVar(&args.TLSCert, "tls-cert", defaults.TLSCert, "client certificate (PEM) for https upstreams, reloaded when changed")
+	flag.StringVar(&args.TLSKey, "tls-key", defaults.TLSKey, "private key (PEM) of -tls-cert")
+	flag.StringVar(&args.TLSCA, "tls-ca", defaults.TLSCA, "CA bundle (PEM) to verify https upstreams against instead of the system's")
+	flag.StringVar(&args.TLSMinVersion, "tls-min-version", defaults.TLSMinVersion, "minimum TLS version for https upstreams: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&args.TLSCipherSuites, "tls-cipher-suites", defaults.TLSCipherSuites, "comma-separated list of TLS 1.0-1.2 cipher suites for https upstreams")
+	flag.StringVar(&args.UpstreamProtocol, "upstream-protocol", defaults.UpstreamProtocol, "protocol for backends: http1, h2 (HTTP/2 via TLS ALPN) or h2c (HTTP/2 only, also without TLS)")
+	flag.StringVar(&args.DNSServers, "dns-servers", defaults.DNSServers, "comma-separated DNS servers (ip[:port]) for -dns-cache (default: from /etc/resolv.conf)")
+	flag.StringVar(&args.ConnectPorts, "connect-ports", defaults.ConnectPorts, "comma-separated list of ports allowed for CONNECT tunnels")
+	flag.StringVar(&args.RoutesFile, "routes-file", defaults.RoutesFile, "file mapping Host patterns to upstreams, see README")
+	flag.StringVar(&args.PrometheusPort, "prometheus-port", defaults.PrometheusPort, "Prometheus monitoring port, e.g. :18080")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [config print] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Flags take precedence over %s* environment variables (e.g. %sCLIENT_TIMEOUT),\n", proxy.EnvPrefix, proxy.EnvPrefix)
+		fmt.Fprintf(flag.CommandLine.Output(), "which take precedence over -config file contents.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.CommandLine.Parse(cmdArgs)
+	if flag.NArg() == 2 && flag.Arg(0) == "config" && flag.Arg(1) == "print" {
+		printConfig = true
+	} else if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Error: unexpected arguments %q, use -h for help\n", flag.Args())
+		os.Exit(2)
+	}
+
+	if args.PrintVersion {
+		proxy.NewProxyInstance(proxy.Settings{PrintVersion: true})
+	}
 
-	flag.IntVar(&args.MaxConnsPerHost, "max-conns-per-host", 20, "maximum number of connections per backend host")
-	flag.IntVar(&args.MaxIdleConns, "max-idle-conns", 100, "maximum number of idle HTTP(S) connections")
-	flag.IntVar(&args.MaxIdleConnsPerHost, "max-idle-conns-per-host", 15, "maximum number of idle conns per backend")
-	flag.IntVar(&args.ClientTimeout, "client-timeout", 5000, "http client connection timeout [ms] for proxy requests")
-	flag.IntVar(&args.IdleConnTimeout, "idle-timeout", 90000, "connection timeout [ms] for idle backend connections")
-	flag.IntVar(&args.SocketReadTimeout, "socket-read-timeout", 5500, "read timeout [ms] for -socket")
-	flag.IntVar(&args.SocketWriteTimeout, "socket-write-timeout", 5500, "write timeout [ms] for -socket")
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "version" {
+			overrides[f.Name] = f.Value.String()
+		}
+	})
+	settings, err := proxy.LoadSettings(configFile, overrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
 
-	flag.StringVar(&args.PidFile, "pid-file", "", "pid file to use, none if empty")
-	flag.StringVar(&args.SocketPath, "socket", os.Getenv("UDS_PROXY_SOCKET"), "path of socket to create")
-	flag.StringVar(&args.PrometheusPort, "prometheus-port", "", "Prometheus monitoring port, e.g. :18080")
+	if printConfig {
+		out, _ := json.MarshalIndent(settings, "", "  ")
+		fmt.Println(string(out))
+		if err := settings.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	flag.Parse()
+	if os.Getuid() == 0 {
+		println("uds-proxy is refusing to run as root user")
+		os.Exit(1)
+	}
 
-	proxy.NewProxyInstance(args).Run()
+	instance := proxy.NewProxyInstance(settings)
+	instance.ConfigLoader = func() (proxy.Settings, error) {
+		return proxy.LoadSettings(configFile, overrides)
+	}
+	if err := instance.Run(); err != nil {
+		log.Fatalf("Error: %s", err)
+	}
 }
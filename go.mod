@@ -1,11 +1,25 @@
 module github.com/schnoddelbotz/uds-proxy
 
-go 1.12
+go 1.24.0
 
 require (
-	github.com/google/go-cmp v0.3.0 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/prometheus/client_golang v0.9.3
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/net v0.44.0
+	gopkg.in/yaml.v2 v2.2.2
 	gotest.tools v2.2.0+incompatible
 )
+
+require (
+	github.com/beorn7/perks v1.0.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/google/go-cmp v0.3.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90 // indirect
+	github.com/prometheus/common v0.4.0 // indirect
+	github.com/prometheus/procfs v0.0.0-20190507164030-5867b95ac084 // indirect
+)
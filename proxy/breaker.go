@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states, exported as values of udsproxy_circuit_breaker_state.
+const (
+	breakerClosed   = 0 // requests pass, outcomes are counted
+	breakerHalfOpen = 1 // a single probe request passes, its outcome decides
+	breakerOpen     = 2 // requests fail fast until breaker-open-time has passed
+)
+
+var breakerStates = []string{"closed", "half-open", "open"}
+
+// Outcomes of upstream requests as seen by circuit breakers and adaptive concurrency limits.
+const (
+	outcomeSuccess   = iota
+	outcomeError     // no response or a 5xx one
+	outcomeTimeout   // no response within client-timeout
+	outcomeCancelled // the client gave up, which says nothing about the upstream
+)
+
+// breakerPolicy holds the trip conditions of a route's circuit breakers, see the breaker-* options.
+// Rates are percentages of the requests within window, evaluated once there are minRequests.
+type breakerPolicy struct {
+	failures, errorRate, timeoutRate, minRequests int
+	window, openTime                              time.Duration
+}
+
+func newBreakerPolicy(opt *Settings) breakerPolicy {
+	return breakerPolicy{
+		failures:    opt.BreakerFailures,
+		errorRate:   opt.BreakerErrorRate,
+		timeoutRate: opt.BreakerTimeoutRate,
+		minRequests: opt.BreakerMinRequests,
+		window:      time.Duration(opt.BreakerWindow) * time.Millisecond,
+		openTime:    time.Duration(opt.BreakerOpenTime) * time.Millisecond,
+	}
+}
+
+// validateBreakerRates checks breaker-error-rate and breaker-timeout-rate, which are percentages.
+func validateBreakerRates(errorRate, timeoutRate int) error {
+	if errorRate < 0 || errorRate > 100 {
+		return fmt.Errorf("breaker-error-rate: must be within 0-100, got %d", errorRate)
+	}
+	if timeoutRate < 0 || timeoutRate > 100 {
+		return fmt.Errorf("breaker-timeout-rate: must be within 0-100, got %d", timeoutRate)
+	}
+	return nil
+}
+
+func (p breakerPolicy) enabled() bool {
+	return p.failures > 0 || p.errorRate > 0 || p.timeoutRate > 0
+}
+
+// circuitBreakers holds a circuit breaker per upstream host:port. They outlive configuration reloads;
+// the policy to apply is passed by the route of each request.
+type circuitBreakers struct {
+	metrics  *appMetrics
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(metrics *appMetrics) *circuitBreakers {
+	return &circuitBreakers{metrics: metrics, breakers: make(map[string]*circuitBreaker)}
+}
+
+func (b *circuitBreakers) get(upstream string) *circuitBreaker {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.breakers[upstream]
+	if !ok {
+		breaker = &circuitBreaker{upstream: upstream, metrics: b.metrics}
+		b.breakers[upstream] = breaker
+		breaker.setGauge()
+	}
+	return breaker
+}
+
+type circuitBreaker struct {
+	upstream string
+	metrics  *appMetrics
+	mutex    sync.Mutex
+	state    int
+	reason   string    // why the breaker opened
+	openedAt time.Time // when the breaker opened
+	probing  bool      // a half-open probe request is in flight
+	period   int       // counts state changes, see breakerTicket
+
+	consecutiveFailures        int
+	windowStart                time.Time
+	requests, errors, timeouts int
+}
+
+// breakerTicket is handed to the requests a circuit breaker allows. Their outcomes only count while
+// the breaker remains in the state they were allowed in; in half-open state, that is the probe only.
+type breakerTicket struct {
+	breaker *circuitBreaker
+	period  int
+}
+
+// allow returns a ticket if a request may be sent to the upstream. If not, it returns the breaker's
+// state and why it opened, and how long until a probe request will be let through.
+func (cb *circuitBreaker) allow(p breakerPolicy) (ticket *breakerTicket, state, reason string, retryAfter time.Duration) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == breakerOpen {
+		if wait := cb.openedAt.Add(p.openTime).Sub(time.Now()); wait > 0 {
+			return nil, breakerStates[cb.state], cb.reason, wait
+		}
+		cb.transition(breakerHalfOpen, "open for "+p.openTime.String())
+	}
+	if cb.state == breakerHalfOpen {
+		if cb.probing {
+			return nil, breakerStates[cb.state], cb.reason, time.Second
+		}
+		cb.probing = true
+	}
+	return &breakerTicket{breaker: cb, period: cb.period}, "", "", 0
+}
+
+// record counts the outcome of a request allowed by allow() and opens or closes the breaker accordingly.
+func (cb *circuitBreaker) record(p breakerPolicy, ticket *breakerTicket, outcome int) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if ticket.period != cb.period {
+		return // allowed before the breaker changed its state
+	}
+	if outcome == outcomeCancelled {
+		if cb.state == breakerHalfOpen {
+			cb.probing = false // let the next request probe
+		}
+		return
+	}
+	switch cb.state {
+	case breakerHalfOpen:
+		cb.probing = false
+		if outcome == outcomeSuccess {
+			cb.transition(breakerClosed, "probe request succeeded")
+		} else {
+			cb.open("probe request failed")
+		}
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(cb.windowStart) > p.window {
+		cb.windowStart, cb.requests, cb.errors, cb.timeouts = now, 0, 0, 0
+	}
+	cb.requests++
+	if outcome == outcomeSuccess {
+		cb.consecutiveFailures = 0
+		return
+	}
+	cb.consecutiveFailures++
+	cb.errors++ // timeouts count as errors, too
+	if outcome == outcomeTimeout {
+		cb.timeouts++
+	}
+
+	switch {
+	case p.failures > 0 && cb.consecutiveFailures >= p.failures:
+		cb.open(fmt.Sprintf("%d consecutive failures", cb.consecutiveFailures))
+	case cb.requests < p.minRequests:
+	case p.errorRate > 0 && cb.errors*100 >= p.errorRate*cb.requests:
+		cb.open(fmt.Sprintf("%d of %d requests failed", cb.errors, cb.requests))
+	case p.timeoutRate > 0 && cb.timeouts*100 >= p.timeoutRate*cb.requests:
+		cb.open(fmt.Sprintf("%d of %d requests timed out", cb.timeouts, cb.requests))
+	}
+}
+
+// upstreamOutcome classifies the result of an upstream request.
+func upstreamOutcome(response *http.Response, err error) int {
+	switch {
+	case err != nil && err.(*url.Error).Timeout():
+		return outcomeTimeout
+	case err != nil || response.StatusCode >= 500:
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// recordOutcome records outcome on the breaker that issued ticket, if the request's route uses one.
+func recordOutcome(ticket *breakerTicket, p breakerPolicy, outcome int) {
+	if ticket != nil {
+		ticket.breaker.record(p, ticket, outcome)
+	}
+}
+
+func (cb *circuitBreaker) open(reason string) {
+	cb.reason, cb.openedAt = reason, time.Now()
+	cb.transition(breakerOpen, reason)
+}
+
+func (cb *circuitBreaker) transition(state int, reason string) {
+	log.Printf("circuit breaker for %s: %s -> %s (%s)", cb.upstream, breakerStates[cb.state], breakerStates[state], reason)
+	cb.state = state
+	cb.period++
+	cb.consecutiveFailures, cb.windowStart, cb.requests, cb.errors, cb.timeouts = 0, time.Now(), 0, 0, 0
+	cb.setGauge()
+}
+
+func (cb *circuitBreaker) setGauge() {
+	if cb.metrics.enabled {
+		cb.metrics.BreakerState.WithLabelValues(cb.upstream).Set(float64(cb.state))
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Modes of concurrency limits: a fixed limit, or one adapted to failures (AIMD) or latencies (gradient).
+const (
+	concurrencyFixed    = "fixed"
+	concurrencyAIMD     = "aimd"
+	concurrencyGradient = "gradient"
+)
+
+const (
+	aimdBackoff       = 0.9  // factor the limit is reduced by on failures
+	gradientSmoothing = 0.2  // weight of a new limit estimate
+	gradientLongAlpha = 0.01 // weight of a latency in the long-term average
+)
+
+// concurrencyPolicy holds the concurrency limit settings of a route, see the concurrency-* options.
+type concurrencyPolicy struct {
+	max          int // limit in fixed mode, initial and maximum limit in adaptive ones; 0 disables
+	queue        int
+	queueTimeout time.Duration
+	mode         string
+}
+
+func newConcurrencyPolicy(opt *Settings) concurrencyPolicy {
+	p := concurrencyPolicy{
+		max:          opt.MaxConcurrency,
+		queue:        opt.ConcurrencyQueue,
+		queueTimeout: time.Duration(opt.ConcurrencyTimeout) * time.Millisecond,
+		mode:         opt.ConcurrencyMode,
+	}
+	if p.mode == "" {
+		p.mode = concurrencyFixed
+	}
+	return p
+}
+
+// validateConcurrencyMode checks the concurrency-mode option.
+func validateConcurrencyMode(mode string) error {
+	switch mode {
+	case "", concurrencyFixed, concurrencyAIMD, concurrencyGradient:
+		return nil
+	}
+	return fmt.Errorf("concurrency-mode: must be %s, %s or %s, got %q", concurrencyFixed, concurrencyAIMD,
+		concurrencyGradient, mode)
+}
+
+func (p concurrencyPolicy) enabled() bool {
+	return p.max > 0
+}
+
+// concurrencyLimiters holds a concurrency limiter per upstream host:port. They outlive configuration
+// reloads; the policy to apply is passed by the route of each request.
+type concurrencyLimiters struct {
+	metrics  *appMetrics
+	mutex    sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+func newConcurrencyLimiters(metrics *appMetrics) *concurrencyLimiters {
+	return &concurrencyLimiters{metrics: metrics, limiters: make(map[string]*concurrencyLimiter)}
+}
+
+func (l *concurrencyLimiters) get(upstream string, p concurrencyPolicy) *concurrencyLimiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limiter, ok := l.limiters[upstream]
+	if !ok {
+		limiter = &concurrencyLimiter{upstream: upstream, metrics: l.metrics, limit: float64(p.max), queue: list.New()}
+		l.limiters[upstream] = limiter
+	}
+	return limiter
+}
+
+// concurrencyLimiter admits up to limit requests to an upstream at a time. Further requests wait in a
+// FIFO queue, which the requests finishing hand their slot to.
+type concurrencyLimiter struct {
+	upstream string
+	metrics  *appMetrics
+	mutex    sync.Mutex
+	limit    float64
+	inflight int
+	queue    *list.List // of *concurrencyWaiter
+	longRTT  float64    // long-term average latency [s] in gradient mode
+}
+
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// acquire takes a slot for request r, waiting for it for up to the queue timeout. If r may not be
+// sent, it returns why.
+func (l *concurrencyLimiter) acquire(r *http.Request, p concurrencyPolicy) error {
+	l.mutex.Lock()
+	switch {
+	case p.mode == concurrencyFixed || l.limit > float64(p.max):
+		l.limit = float64(p.max)
+	case l.limit < 1:
+		l.limit = 1
+	}
+	l.admit() // in case the limit was raised by a reload
+	if l.inflight < int(l.limit) && l.queue.Len() == 0 {
+		l.inflight++
+		l.mutex.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= p.queue {
+		l.mutex.Unlock()
+		l.countRejected("queue-full")
+		return fmt.Errorf("%d requests queued", p.queue)
+	}
+	waiter := &concurrencyWaiter{ready: make(chan struct{})}
+	element := l.queue.PushBack(waiter)
+	l.setQueueDepth()
+	l.mutex.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+	case <-timer.C:
+		err = fmt.Errorf("queued for %s", p.queueTimeout)
+	case <-r.Context().Done():
+		err = r.Context().Err()
+	}
+	if err != nil {
+		l.mutex.Lock()
+		if waiter.granted { // handed a slot while giving up
+			err = nil
+		} else {
+			l.queue.Remove(element)
+			l.setQueueDepth()
+		}
+		l.mutex.Unlock()
+	}
+	l.observeWait(time.Since(start))
+	if err != nil && r.Context().Err() == nil {
+		l.countRejected("queue-timeout")
+	}
+	return err
+}
+
+// tryAcquire takes a slot if one is free and no request is waiting for it.
+func (l *concurrencyLimiter) tryAcquire() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.inflight < int(l.limit) && l.queue.Len() == 0 {
+		l.inflight++
+		return true
+	}
+	return false
+}
+
+// release frees the slot of a request that was not sent, or of a hedge.
+func (l *concurrencyLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inflight--
+	l.admit()
+}
+
+// done frees the slot of a request that was answered after latency with outcome, adapting the limit
+// in aimd and gradient mode. Requests cancelled by their client tell nothing about the upstream's
+// load and leave the limit alone.
+func (l *concurrencyLimiter) done(p concurrencyPolicy, latency time.Duration, outcome int) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.inflight--
+	switch {
+	case outcome == outcomeCancelled:
+	case p.mode == concurrencyAIMD:
+		if outcome == outcomeSuccess {
+			l.limit += 1 / l.limit
+		} else {
+			l.limit *= aimdBackoff
+		}
+	case p.mode == concurrencyGradient:
+		l.adaptToLatency(latency.Seconds())
+	}
+	l.limit = math.Max(1, math.Min(l.limit, float64(p.max)))
+	if l.metrics.enabled {
+		l.metrics.ConcurrencyLimit.WithLabelValues(l.upstream).Set(math.Floor(l.limit))
+	}
+	l.admit()
+}
+
+// adaptToLatency moves the limit towards limit*gradient plus a queue allowance of sqrt(limit), the
+// gradient being the ratio of the long-term average latency to the current one, within 0.5 and 1.
+// Growing latencies hence shrink the limit, stable ones let it grow.
+func (l *concurrencyLimiter) adaptToLatency(rtt float64) {
+	if rtt <= 0 {
+		return
+	}
+	if l.longRTT == 0 {
+		l.longRTT = rtt
+	}
+	l.longRTT += (rtt - l.longRTT) * gradientLongAlpha
+	if l.longRTT > 2*rtt { // latencies recovered, forget the slow past faster
+		l.longRTT = 2 * rtt
+	}
+	gradient := math.Max(0.5, math.Min(1, l.longRTT/rtt))
+	estimate := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*(1-gradientSmoothing) + estimate*gradientSmoothing
+}
+
+// admit hands free slots to queued requests, oldest first.
+func (l *concurrencyLimiter) admit() {
+	for l.inflight < int(l.limit) && l.queue.Len() > 0 {
+		waiter := l.queue.Remove(l.queue.Front()).(*concurrencyWaiter)
+		waiter.granted = true
+		close(waiter.ready)
+		l.inflight++
+	}
+	l.setQueueDepth()
+}
+
+func (l *concurrencyLimiter) setQueueDepth() {
+	if l.metrics.enabled {
+		l.metrics.QueueDepth.WithLabelValues(l.upstream).Set(float64(l.queue.Len()))
+	}
+}
+
+func (l *concurrencyLimiter) observeWait(wait time.Duration) {
+	if l.metrics.enabled {
+		l.metrics.QueueWait.WithLabelValues(l.upstream).Observe(wait.Seconds())
+	}
+}
+
+func (l *concurrencyLimiter) countRejected(reason string) {
+	if l.metrics.enabled {
+		l.metrics.QueueRejections.WithLabelValues(l.upstream, reason).Inc()
+	}
+}
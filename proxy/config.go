@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to option names (upper-cased, dashes replaced by underscores)
+// to form the environment variables consulted by LoadSettings, e.g. UDS_PROXY_CLIENT_TIMEOUT.
+const EnvPrefix = "UDS_PROXY_"
+
+// DefaultSettings returns the settings uds-proxy uses for options that are not configured otherwise.
+func DefaultSettings() Settings {
+	return Settings{
+		ClientTimeout:         5000,
+		MaxConnsPerHost:       20,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   15,
+		IdleConnTimeout:       90000,
+		SocketReadTimeout:     5500,
+		SocketWriteTimeout:    5500,
+		FlushInterval:         100,
+		ShutdownTimeout:       10000,
+		ConnectPorts:          "443",
+		UpstreamProtocol:      "http1",
+		H2PingTimeout:         15000,
+		RetryBackoff:          50,
+		RetryBufferSize:       65536,
+		BreakerMinRequests:    20,
+		BreakerWindow:         10000,
+		BreakerOpenTime:       5000,
+		HedgeBudget:           5,
+		HedgeMinDelay:         10,
+		RateLimitBurst:        1,
+		RateLimitMode:         "queue",
+		RateLimitQueueTimeout: 1000,
+		RateLimitMaxPause:     60000,
+		ConcurrencyQueue:      100,
+		ConcurrencyTimeout:    1000,
+		ConcurrencyMode:       "fixed",
+		DNSStaleTTL:           600000,
+	}
+}
+
+// LoadSettings resolves the effective configuration. In order of increasing precedence, options are
+// taken from DefaultSettings(), configFile (if not empty), UDS_PROXY_* environment variables and
+// overrides, which map option names (e.g. "client-timeout") to values -- usually explicitly set flags.
+func LoadSettings(configFile string, overrides map[string]string) (Settings, error) {
+	settings := DefaultSettings()
+	if configFile != "" {
+		if err := decodeConfigFile(configFile, &settings); err != nil {
+			return settings, err
+		}
+	}
+	for _, name := range settings.optionNames() {
+		if value, ok := os.LookupEnv(envName(name)); ok {
+			if err := settings.Set(name, value); err != nil {
+				return settings, fmt.Errorf("%s: %s", envName(name), err)
+			}
+		}
+	}
+	for name, value := range overrides {
+		if err := settings.Set(name, value); err != nil {
+			return settings, fmt.Errorf("-%s: %s", name, err)
+		}
+	}
+	return settings, nil
+}
+
+// Set assigns value to the scalar option name, e.g. Set("client-timeout", "2500").
+func (s *Settings) Set(name, value string) error {
+	field, ok := s.optionField(name)
+	if !ok {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("option %q can only be set in a configuration file", name)
+	}
+	return nil
+}
+
+// Validate checks the settings for consistency and returns the first problem found.
+func (s *Settings) Validate() error {
+	if s.SocketPath == "" {
+		return fmt.Errorf("socket: a socket path must be provided (-socket, %sSOCKET or config file)", EnvPrefix)
+	}
+	if err := validateSocketPath(s.SocketPath); err != nil {
+		return fmt.Errorf("socket: %s", err)
+	}
+	nonNegative := map[string]int{
+		"client-timeout":            s.ClientTimeout,
+		"max-conns-per-host":        s.MaxConnsPerHost,
+		"max-idle-conns":            s.MaxIdleConns,
+		"max-idle-conns-per-host":   s.MaxIdleConnsPerHost,
+		"idle-timeout":              s.IdleConnTimeout,
+		"socket-read-timeout":       s.SocketReadTimeout,
+		"socket-write-timeout":      s.SocketWriteTimeout,
+		"shutdown-timeout":          s.ShutdownTimeout,
+		"h2-max-concurrent-streams": s.H2MaxConcurrentStreams,
+		"h2-ping-interval":          s.H2PingInterval,
+		"h2-ping-timeout":           s.H2PingTimeout,
+		"retries":                   s.Retries,
+		"retry-backoff":             s.RetryBackoff,
+		"retry-buffer-size":         s.RetryBufferSize,
+		"breaker-failures":          s.BreakerFailures,
+		"breaker-min-requests":      s.BreakerMinRequests,
+		"breaker-window":            s.BreakerWindow,
+		"breaker-open-time":         s.BreakerOpenTime,
+		"hedge-min-delay":           s.HedgeMinDelay,
+		"rate-limit-burst":          s.RateLimitBurst,
+		"rate-limit-queue-timeout":  s.RateLimitQueueTimeout,
+		"rate-limit-max-pause":      s.RateLimitMaxPause,
+		"max-concurrency":           s.MaxConcurrency,
+		"concurrency-queue":         s.ConcurrencyQueue,
+		"concurrency-timeout":       s.ConcurrencyTimeout,
+		"dns-stale-ttl":             s.DNSStaleTTL,
+	}
+	for _, name := range s.optionNames() {
+		if value, ok := nonNegative[name]; ok && value < 0 {
+			return fmt.Errorf("%s: must not be negative, got %d", name, value)
+		}
+	}
+	if s.FlushInterval < -1 {
+		return fmt.Errorf("flush-interval: must be -1 or greater, got %d", s.FlushInterval)
+	}
+	if s.PrometheusPort != "" {
+		if _, _, err := net.SplitHostPort(s.PrometheusPort); err != nil {
+			return fmt.Errorf("prometheus-port: %q is not of form [host]:port", s.PrometheusPort)
+		}
+	}
+	if s.ListenTCP != "" {
+		if err := validateLoopbackAddress(s.ListenTCP); err != nil {
+			return fmt.Errorf("listen-tcp: %s", err)
+		}
+	}
+	if _, err := parseSocketMode(s.SocketMode); err != nil {
+		return fmt.Errorf("socket-mode: %s", err)
+	}
+	if err := validateUpstreamProtocol(s.UpstreamProtocol); err != nil {
+		return fmt.Errorf("upstream-protocol: %s", err)
+	}
+	if err := validateUpstreamTLS(s.TLSCert, s.TLSKey, s.TLSMinVersion, s.TLSCipherSuites); err != nil {
+		return err
+	}
+	if err := validateBreakerRates(s.BreakerErrorRate, s.BreakerTimeoutRate); err != nil {
+		return err
+	}
+	if err := validateHedging(s.HedgePercentile, s.HedgeBudget); err != nil {
+		return err
+	}
+	if err := validateRateLimit(s.RateLimit, s.RateLimitMode, s.RateLimitKey); err != nil {
+		return err
+	}
+	if err := validateConcurrencyMode(s.ConcurrencyMode); err != nil {
+		return err
+	}
+	if _, err := parseDNSServers(s.DNSServers); err != nil {
+		return fmt.Errorf("dns-servers: %s", err)
+	}
+	if _, err := parseHostOverrides(s.HostOverrides); err != nil {
+		return fmt.Errorf("host-overrides: %s", err)
+	}
+	if _, err := parsePortList(s.ConnectPorts); err != nil {
+		return fmt.Errorf("connect-ports: %s", err)
+	}
+	for i, r := range s.Routes {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %s", i, err)
+		}
+	}
+	return s.validateListeners()
+}
+
+// optionNames lists the names of all options that can be configured, in declaration order.
+func (s *Settings) optionNames() (names []string) {
+	t := reflect.TypeOf(*s)
+	for i := 0; i < t.NumField(); i++ {
+		if name := optionName(t.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func (s *Settings) optionField(name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if optionName(v.Type().Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func optionName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func envName(option string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(option, "-", "_", -1))
+}
+
+// decodeConfigFile reads a JSON, YAML or TOML file (by extension) into v, which must be a pointer to
+// a struct using json tags. Keys that do not match any field are reported as errors.
+func decodeConfigFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var generic interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &generic)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &generic)
+		generic = normalizeYAML(generic)
+	case ".toml":
+		var table map[string]interface{}
+		_, err = toml.Decode(string(data), &table)
+		generic = table
+	default:
+		return fmt.Errorf("%s: unsupported configuration file type, use .json, .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	// decode via JSON so that a single set of struct tags serves all formats
+	normalized, err := json.Marshal(generic)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(normalized))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", path, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by yaml.v2 into
+// map[string]interface{}, which encoding/json can handle.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeYAML(value)
+		}
+	}
+	return v
+}
@@ -0,0 +1,401 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsQueryTimeout limits a lookup, which is shared by all requests waiting for its answer.
+const dnsQueryTimeout = 5 * time.Second
+
+// errNoSuchHost is the answer of a DNS server that knows the name has no addresses.
+var errNoSuchHost = errors.New("no such host")
+
+// parseDNSServers parses a comma-separated list of DNS server addresses (ip or ip:port); empty
+// yields the nameservers of /etc/resolv.conf.
+func parseDNSServers(list string) ([]string, error) {
+	if list == "" {
+		return systemNameservers(), nil
+	}
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		host, port, err := net.SplitHostPort(server)
+		if err != nil {
+			host, port = strings.Trim(server, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("%q is not an IP address", server)
+		}
+		servers = append(servers, net.JoinHostPort(host, port))
+	}
+	return servers, nil
+}
+
+// systemNameservers returns the nameservers of /etc/resolv.conf, or the local resolver if none are set.
+func systemNameservers() (servers []string) {
+	if file, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return
+}
+
+// dnsCache holds the addresses of upstream hosts for their TTL, and afterwards for use while DNS servers
+// fail. It outlives configuration reloads; the servers to ask are configured per dnsResolver.
+type dnsCache struct {
+	metrics *appMetrics
+	mutex   sync.Mutex
+	entries map[string]*dnsEntry
+	lookups map[string]*dnsLookup // in progress, shared by requests for the same host
+}
+
+type dnsEntry struct {
+	ips     []net.IP
+	expires time.Time
+	next    uint32 // index of the address to dial first; accessed atomically
+}
+
+type dnsLookup struct {
+	done  chan struct{}
+	entry *dnsEntry
+	err   error
+}
+
+func newDNSCache(metrics *appMetrics) *dnsCache {
+	return &dnsCache{metrics: metrics, entries: make(map[string]*dnsEntry), lookups: make(map[string]*dnsLookup)}
+}
+
+// addresses returns the entry's addresses, starting with a different one each time so that
+// connections spread across all A and AAAA records.
+func (e *dnsEntry) addresses() []net.IP {
+	start := int(atomic.AddUint32(&e.next, 1)-1) % len(e.ips)
+	return append(e.ips[start:len(e.ips):len(e.ips)], e.ips[:start]...)
+}
+
+func (c *dnsCache) count(result string) {
+	if c.metrics.enabled {
+		c.metrics.DNSCacheLookups.WithLabelValues(result).Inc()
+	}
+}
+
+// dialMinTimeout is the time each address gets when dialling, if the deadline leaves enough.
+const dialMinTimeout = 2 * time.Second
+
+// dnsResolver looks up upstream hosts by asking servers, caching answers in cache. Expired answers
+// are served for up to staleTTL if no server answers. Dials without deadline, as http.Transport's
+// are, take up to dialTimeout.
+type dnsResolver struct {
+	cache       *dnsCache
+	servers     []string
+	staleTTL    time.Duration
+	dialTimeout time.Duration
+}
+
+// dialContext connects to address, trying all addresses of its host until one accepts. Like
+// net.Dialer, it gives each address a share of the time left, so one that does not answer leaves
+// time for the others. It is used as http.Transport.DialContext.
+func (r *dnsResolver) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok && r.dialTimeout > 0 {
+		deadline = time.Now().Add(r.dialTimeout)
+	}
+	var dialer net.Dialer
+	for i, ip := range ips {
+		if !deadline.IsZero() {
+			dialer.Deadline = partialDeadline(time.Now(), deadline, len(ips)-i)
+		}
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// partialDeadline returns the deadline for dialling the first of remaining addresses, sharing the time
+// left until deadline evenly, but giving it at least dialMinTimeout of that time.
+func partialDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	if left <= 0 {
+		return deadline
+	}
+	timeout := left / time.Duration(remaining)
+	if timeout < dialMinTimeout {
+		timeout = dialMinTimeout
+		if left < timeout {
+			timeout = left
+		}
+	}
+	return now.Add(timeout)
+}
+
+// lookup returns the addresses of host. IP addresses are returned as is, single-label names such as
+// localhost are left to the system resolver as they depend on /etc/hosts or search domains.
+func (r *dnsResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if !strings.Contains(strings.TrimSuffix(host, "."), ".") {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, err
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c := r.cache
+	c.mutex.Lock()
+	entry := c.entries[host]
+	if entry != nil && time.Now().Before(entry.expires) {
+		c.mutex.Unlock()
+		c.count("hit")
+		return entry.addresses(), nil
+	}
+	lookup, ok := c.lookups[host]
+	if !ok {
+		lookup = &dnsLookup{done: make(chan struct{})}
+		c.lookups[host] = lookup
+		go r.refresh(host, lookup)
+	}
+	c.mutex.Unlock()
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	dnsDone := func(err error) {
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{Err: err})
+		}
+	}
+	select {
+	case <-lookup.done:
+		dnsDone(lookup.err)
+	case <-ctx.Done():
+		dnsDone(ctx.Err())
+		return nil, ctx.Err()
+	}
+
+	if lookup.err == nil {
+		c.count("miss")
+		return lookup.entry.addresses(), nil
+	}
+	if entry != nil && lookup.err != errNoSuchHost && time.Now().Before(entry.expires.Add(r.staleTTL)) {
+		c.count("stale")
+		return entry.addresses(), nil
+	}
+	c.count("miss")
+	return nil, &net.DNSError{Err: lookup.err.Error(), Name: host, IsNotFound: lookup.err == errNoSuchHost}
+}
+
+// refresh asks the DNS servers for host and caches the answer, dropping entries that are too old to
+// be served even if stale.
+func (r *dnsResolver) refresh(host string, lookup *dnsLookup) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsQueryTimeout)
+	defer cancel()
+	ips, ttl, err := r.query(ctx, host)
+	if err != nil && err != errNoSuchHost {
+		log.Printf("dns cache: looking up %s failed: %s", host, err)
+	}
+
+	c := r.cache
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if err == nil {
+		lookup.entry = &dnsEntry{ips: ips, expires: now.Add(ttl)}
+		c.entries[host] = lookup.entry
+	}
+	lookup.err = err
+	delete(c.lookups, host)
+	close(lookup.done)
+	for name, entry := range c.entries {
+		if now.After(entry.expires.Add(r.staleTTL)) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// query returns the A and AAAA records of host from the first server that answers, and the
+// shortest TTL among the records.
+func (r *dnsResolver) query(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error) {
+	for _, server := range r.servers {
+		if ips, ttl, err = queryServer(ctx, server, host); err == nil || err == errNoSuchHost {
+			return
+		}
+	}
+	return
+}
+
+func queryServer(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	answers := make(chan answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			ips, ttl, err := exchange(ctx, server, host, qtype)
+			answers <- answer{ips, ttl, err}
+		}(qtype)
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		if a.err != nil {
+			if err == nil || err == errNoSuchHost {
+				err = a.err // report failing servers rather than missing names
+			}
+			continue
+		}
+		if len(a.ips) > 0 && (ips == nil || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+		ips = append(ips, a.ips...)
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	if err == nil {
+		err = errNoSuchHost
+	}
+	return nil, 0, err
+}
+
+// exchange sends a query for host's records of type qtype to server via UDP, repeating it via TCP if
+// the answer was truncated, and returns the addresses found along with their shortest TTL.
+func exchange(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	response, err := roundTrip(ctx, "udp", server, query)
+	if err == nil && response.Truncated {
+		response, err = roundTrip(ctx, "tcp", server, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNoSuchHost
+	default:
+		return nil, 0, fmt.Errorf("server %s answered %s", server, strings.TrimPrefix(response.RCode.String(), "RCode"))
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for i, resource := range response.Answers {
+		if i == 0 || resource.Header.TTL < ttl { // including CNAMEs leading to the addresses
+			ttl = resource.Header.TTL
+		}
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// roundTrip sends query to server and reads the response; TCP messages are prefixed by their length.
+func roundTrip(ctx context.Context, network, server string, query dnsmessage.Message) (*dnsmessage.Message, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		packed = append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)
+	}
+	if _, err = conn.Write(packed); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		var n int
+		if network == "tcp" {
+			if _, err = io.ReadFull(conn, buffer[:2]); err == nil {
+				n = int(binary.BigEndian.Uint16(buffer[:2]))
+				_, err = io.ReadFull(conn, buffer[:n])
+			}
+		} else {
+			n, err = conn.Read(buffer)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buffer[:n])
+		if err != nil || !header.Response || header.ID != query.ID {
+			if network == "tcp" {
+				return nil, fmt.Errorf("server %s sent an invalid response", server)
+			}
+			continue // not the answer to query, e.g. a late answer to a previous query
+		}
+		response := &dnsmessage.Message{Header: header}
+		if header.Truncated {
+			return response, nil // to be repeated via TCP, records may be incomplete
+		}
+		if err = response.Unpack(buffer[:n]); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// grpcCodes names the gRPC status codes, indexed by code.
+var grpcCodes = []string{"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE",
+	"UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"}
+
+// isGRPC reports whether a request or response carries gRPC, i.e. application/grpc or application/grpc+proto etc.
+func isGRPC(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// grpcStatus returns the name of the status of a gRPC response whose body has been consumed. The status is
+// sent as trailer, or as header if the response has no body ("Trailers-Only"). Without a status, the call
+// failed as far as the client is concerned, which gRPC reports as UNKNOWN.
+func grpcStatus(response *http.Response) string {
+	status := response.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = response.Header.Get("Grpc-Status")
+	}
+	if code, err := strconv.Atoi(status); err == nil && code >= 0 && code < len(grpcCodes) {
+		return grpcCodes[code]
+	}
+	return "UNKNOWN"
+}
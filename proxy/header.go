@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are connection-specific headers that a proxy must not forward (RFC 7230, section 6.1).
+// Headers starting with "Proxy-" are treated as hop-by-hop, too.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeader adds all values of all headers in src to dst.
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// removeHopByHopHeaders drops hop-by-hop headers from h, including any header named in Connection.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	for name := range h {
+		if strings.HasPrefix(name, "Proxy-") {
+			delete(h, name)
+		}
+	}
+}
+
+// announceTrailers declares the trailers of backendResponse on w, which must happen before WriteHeader.
+func announceTrailers(w http.ResponseWriter, backendResponse *http.Response) {
+	if len(backendResponse.Trailer) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(backendResponse.Trailer))
+	for k := range backendResponse.Trailer {
+		keys = append(keys, k)
+	}
+	w.Header().Add("Trailer", strings.Join(keys, ", "))
+}
+
+// copyTrailers forwards trailer values of backendResponse once its body has been consumed.
+// Trailers that were not announced upfront are sent using http.TrailerPrefix.
+func copyTrailers(w http.ResponseWriter, backendResponse *http.Response, announced int) {
+	if len(backendResponse.Trailer) == announced {
+		copyHeader(w.Header(), backendResponse.Trailer)
+		return
+	}
+	for k, vv := range backendResponse.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// headerHasToken reports whether the comma-separated header name in h contains token (case-insensitive).
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hedgeSamples    = 1000 // latencies the hedge delay is computed from
+	hedgeMinSamples = 20   // latencies observed before requests are hedged
+	hedgeBurst      = 10   // hedges the budget may save up while upstreams are fast
+)
+
+// validateHedging checks hedge-percentile and hedge-budget, which are percentages.
+func validateHedging(percentile, budget int) error {
+	if percentile < 0 || percentile > 100 {
+		return fmt.Errorf("hedge-percentile: must be within 0-100, got %d", percentile)
+	}
+	if budget < 0 || budget > 100 {
+		return fmt.Errorf("hedge-budget: must be within 0-100, got %d", budget)
+	}
+	return nil
+}
+
+// hedgingTransport sends a second attempt of GET and HEAD requests without body if the first has
+// not been answered within the percentile'th percentile of the route's latencies (but at least
+// minDelay). The first response wins, the other attempt is cancelled. Hedges are limited to budget
+// percent of the requests, and to the route's rate and concurrency limits, see hedgeLimits.
+type hedgingTransport struct {
+	transport  http.RoundTripper
+	percentile int
+	budget     int
+	minDelay   time.Duration
+	sent, won  func() // count hedges, if metrics are enabled
+
+	mutex     sync.Mutex
+	latencies []time.Duration // ring buffer of the last hedgeSamples latencies
+	next      int
+	observed  int           // latencies observed since the delay was computed
+	delay     time.Duration // 0 until hedgeMinSamples latencies were observed
+	credit    int           // in hundredths of a hedge
+}
+
+type hedgeResult struct {
+	response *http.Response
+	err      error
+	hedge    bool
+	latency  time.Duration
+	cancel   context.CancelFunc
+}
+
+func (t *hedgingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead ||
+		request.Body != nil && request.Body != http.NoBody {
+		return t.transport.RoundTrip(request)
+	}
+	delay := t.hedgeDelay()
+	if delay == 0 {
+		start := time.Now()
+		response, err := t.transport.RoundTrip(request)
+		if err == nil {
+			t.observe(time.Since(start))
+		}
+		return response, err
+	}
+
+	results := make(chan hedgeResult, 2)
+	t.send(request, nil, results)
+	pending := 1
+	hedgeTimer := time.NewTimer(delay)
+	defer hedgeTimer.Stop()
+	timer := hedgeTimer.C
+	var failed hedgeResult
+	for {
+		select {
+		case <-timer:
+			timer = nil
+			if !t.spend() {
+				continue
+			}
+			release, ok := requestHedgeLimits(request).admit()
+			if !ok {
+				t.refund()
+				continue
+			}
+			pending++
+			t.send(request, release, results)
+			if t.sent != nil {
+				t.sent()
+			}
+		case result := <-results:
+			pending--
+			if result.err != nil {
+				result.cancel()
+				if pending > 0 {
+					failed = result // the other attempt may still succeed
+					continue
+				}
+				if result.hedge && failed.err != nil {
+					result = failed // report the original attempt's error
+				}
+				return nil, result.err
+			}
+			t.observe(result.latency)
+			if result.hedge && t.won != nil {
+				t.won()
+			}
+			if pending > 0 {
+				go discardHedge(results)
+			}
+			result.response.Body = &cancelOnClose{ReadCloser: result.response.Body, cancel: result.cancel}
+			return result.response, nil
+		}
+	}
+}
+
+// send starts an attempt of request, reporting its result to results. The attempt is cancelled
+// once its response body is closed, or when the other attempt wins. Hedges pass release, which
+// frees their concurrency slot then.
+func (t *hedgingTransport) send(request *http.Request, release func(), results chan<- hedgeResult) {
+	ctx, cancel := context.WithCancel(request.Context())
+	if release != nil {
+		var once sync.Once
+		cancelAttempt := cancel
+		cancel = func() {
+			cancelAttempt()
+			once.Do(release)
+		}
+	}
+	attempt := request.Clone(ctx)
+	go func() {
+		start := time.Now()
+		response, err := t.transport.RoundTrip(attempt)
+		results <- hedgeResult{response, err, release != nil, time.Since(start), cancel}
+	}()
+}
+
+// discardHedge cancels the attempt that lost, closing its response if it arrived anyway.
+func discardHedge(results <-chan hedgeResult) {
+	result := <-results
+	result.cancel()
+	if result.response != nil {
+		result.response.Body.Close()
+	}
+}
+
+// hedgeDelay returns how long to wait for a response before hedging, 0 if the request must not be
+// hedged. Each request adds budget hundredths of a hedge to the credit.
+func (t *hedgingTransport) hedgeDelay() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.credit += t.budget; t.credit > hedgeBurst*100 {
+		t.credit = hedgeBurst * 100
+	}
+	if t.delay == 0 || t.credit < 100 {
+		return 0
+	}
+	if t.delay < t.minDelay {
+		return t.minDelay
+	}
+	return t.delay
+}
+
+// spend takes a hedge from the credit, if there is one.
+func (t *hedgingTransport) spend() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.credit < 100 {
+		return false
+	}
+	t.credit -= 100
+	return true
+}
+
+// refund returns a hedge to the credit that could not be sent after all.
+func (t *hedgingTransport) refund() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.credit += 100
+}
+
+// observe records the latency of a response, recomputing the hedge delay every hedgeMinSamples.
+func (t *hedgingTransport) observe(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.latencies) < hedgeSamples {
+		t.latencies = append(t.latencies, latency)
+	} else {
+		t.latencies[t.next] = latency
+		t.next = (t.next + 1) % hedgeSamples
+	}
+	if t.observed++; t.observed < hedgeMinSamples {
+		return
+	}
+	t.observed = 0
+	sorted := append([]time.Duration(nil), t.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := len(sorted) * t.percentile / 100
+	if index == len(sorted) {
+		index--
+	}
+	t.delay = sorted[index]
+}
+
+// hedgeLimits holds the rate limit bucket and concurrency limiter a request passed. Its hedge must
+// pass them as well, but does not wait: rather than queueing behind other requests, or delaying the
+// requests queued, the request is not hedged if no token or slot is free.
+type hedgeLimits struct {
+	bucket  *tokenBucket
+	rate    rateLimitPolicy
+	limiter *concurrencyLimiter
+}
+
+type hedgeLimitsKey struct{}
+
+// withHedgeLimits returns a copy of request whose hedges are subject to limits.
+func withHedgeLimits(request *http.Request, limits *hedgeLimits) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), hedgeLimitsKey{}, limits))
+}
+
+func requestHedgeLimits(request *http.Request) *hedgeLimits {
+	limits, _ := request.Context().Value(hedgeLimitsKey{}).(*hedgeLimits)
+	return limits
+}
+
+// admit takes a token and a slot for a hedge if both are free, returning a function that frees the
+// slot once the hedge is done.
+func (l *hedgeLimits) admit() (release func(), ok bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	if l.bucket != nil && !l.bucket.take(l.rate) {
+		return nil, false
+	}
+	if l.limiter != nil && !l.limiter.tryAcquire() {
+		if l.bucket != nil {
+			l.bucket.cancel(l.rate)
+		}
+		return nil, false
+	}
+	return l.limiter.release, true
+}
+
+// cancelOnClose cancels the context of the request that returned the body once it has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hostOverrides maps upstream hosts to the addresses to connect to instead, like /etc/hosts does for
+// names. Keys are host or host:port, values host (keeping the port) or host:port.
+type hostOverrides map[string]string
+
+// parseHostOverrides validates and normalizes the host-overrides option.
+func parseHostOverrides(overrides map[string]string) (hostOverrides, error) {
+	parsed := make(hostOverrides, len(overrides))
+	for from, to := range overrides {
+		key := strings.ToLower(strings.TrimSuffix(from, "."))
+		if !isHostOrHostPort(key) {
+			return nil, fmt.Errorf("%q: invalid host, expected host or host:port", from)
+		}
+		if !isHostOrHostPort(to) {
+			return nil, fmt.Errorf("%q: invalid address %q, expected host or host:port", from, to)
+		}
+		parsed[key] = to
+	}
+	return parsed, nil
+}
+
+// isHostOrHostPort reports whether address is a host name, an IP address or either with a port.
+func isHostOrHostPort(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return net.ParseIP(address) != nil || address != "" && !strings.ContainsAny(address, ":/[]")
+	}
+	n, err := strconv.Atoi(port)
+	return host != "" && !strings.Contains(host, "/") && err == nil && n >= 1 && n <= 65535
+}
+
+// apply returns the address to connect to instead of address (host:port), if overridden.
+// Overrides for host:port take precedence over those for host.
+func (o hostOverrides) apply(address string) (string, bool) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	to, ok := o[net.JoinHostPort(host, port)]
+	if !ok {
+		if to, ok = o[host]; !ok {
+			return address, false
+		}
+	}
+	if _, _, err := net.SplitHostPort(to); err != nil {
+		to = net.JoinHostPort(strings.Trim(to, "[]"), port)
+	}
+	return to, true
+}
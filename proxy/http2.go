@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upstream protocols, see Settings.UpstreamProtocol.
+const (
+	protocolHTTP1 = "http1" // HTTP/1.1 only
+	protocolH2    = "h2"    // HTTP/2 if negotiated via TLS ALPN, else HTTP/1.1
+	protocolH2C   = "h2c"   // HTTP/2 only, using prior knowledge for http upstreams
+)
+
+// validateUpstreamProtocol checks a value of upstream-protocol; empty selects the default.
+func validateUpstreamProtocol(protocol string) error {
+	switch protocol {
+	case "", protocolHTTP1, protocolH2, protocolH2C:
+		return nil
+	}
+	return fmt.Errorf("must be %s, %s or %s, got %q", protocolHTTP1, protocolH2, protocolH2C, protocol)
+}
+
+// configureHTTP2 enables HTTP/2 on transport as requested by opt.UpstreamProtocol, with ping health
+// checks of idle connections if opt.H2PingInterval is set.
+func configureHTTP2(transport *http.Transport, opt *Settings) {
+	if opt.UpstreamProtocol != protocolH2 && opt.UpstreamProtocol != protocolH2C {
+		return
+	}
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	if opt.UpstreamProtocol == protocolH2 {
+		transport.Protocols.SetHTTP1(true)
+	} else {
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.HTTP2 = &http.HTTP2Config{
+		SendPingTimeout: time.Duration(opt.H2PingInterval) * time.Millisecond,
+		PingTimeout:     time.Duration(opt.H2PingTimeout) * time.Millisecond,
+	}
+}
+
+// streamLimiter caps the requests in flight per upstream host. As HTTP/2 multiplexes requests
+// over few connections, max-conns-per-host no longer limits concurrency; h2-max-concurrent-streams
+// does. Requests above the limit wait for a slot until their context is done.
+type streamLimiter struct {
+	transport http.RoundTripper
+	max       int
+	mutex     sync.Mutex
+	hosts     map[string]chan struct{}
+}
+
+func newStreamLimiter(transport http.RoundTripper, max int) *streamLimiter {
+	return &streamLimiter{transport: transport, max: max, hosts: make(map[string]chan struct{})}
+}
+
+func (l *streamLimiter) RoundTrip(request *http.Request) (*http.Response, error) {
+	l.mutex.Lock()
+	slots, ok := l.hosts[request.URL.Host]
+	if !ok {
+		slots = make(chan struct{}, l.max)
+		l.hosts[request.URL.Host] = slots
+	}
+	l.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+	response, err := l.transport.RoundTrip(request)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	response.Body = &releasingBody{ReadCloser: response.Body, release: func() { <-slots }}
+	return response, nil
+}
+
+// releasingBody calls release once the response body is closed, i.e. the stream is done.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
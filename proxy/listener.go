@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// trackingListener counts accepted connections until they are closed. This lets drain() wait for
+// connections http.Server.Shutdown() does not know about: hijacked ones (tunnels) and those
+// accepted while the listener was being closed. Of these, idle counts the connections waiting for
+// further requests, see trackedConn.setIdle(). Connections carry the name of their listener.
+type trackingListener struct {
+	net.Listener
+	name string
+	open *int64
+	idle *int64
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(l.open, 1)
+	return &trackedConn{Conn: conn, listener: l.name, open: l.open, idle: l.idle}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	listener  string
+	open      *int64
+	idle      *int64
+	isIdle    int32
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.setIdle(false)
+		atomic.AddInt64(c.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// setIdle records whether the connection waits for further requests. It is called by the
+// http.Server's ConnState hook.
+func (c *trackedConn) setIdle(idle bool) {
+	var value int32
+	if idle {
+		value = 1
+	}
+	if previous := atomic.SwapInt32(&c.isIdle, value); previous != value {
+		atomic.AddInt64(c.idle, int64(value-previous))
+	}
+}
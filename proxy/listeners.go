@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// defaultListener names the listener defined by the top-level Settings, i.e. -socket.
+const defaultListener = "default"
+
+// Listener defines a further socket served by the same process. Requests arriving on it are
+// routed by its own Routes or, without any, to its default upstream (Scheme, Address, Port and
+// HostOverride as for a Route). Zero values fall back to the global Settings; -routes-file
+// only applies to -socket.
+//
+// AllowUIDs and AllowGIDs restrict access to the whole listener, see Route.
+type Listener struct {
+	Name          string  `json:"name,omitempty"`
+	Socket        string  `json:"socket"`
+	SocketMode    string  `json:"socket-mode,omitempty"`
+	SocketGroup   string  `json:"socket-group,omitempty"`
+	Scheme        string  `json:"scheme,omitempty"`
+	Address       string  `json:"address,omitempty"`
+	Port          int     `json:"port,omitempty"`
+	HostOverride  string  `json:"host-override,omitempty"`
+	ClientTimeout int     `json:"client-timeout,omitempty"`
+	AllowUIDs     []int   `json:"allow-uids,omitempty"`
+	AllowGIDs     []int   `json:"allow-gids,omitempty"`
+	Routes        []Route `json:"routes,omitempty"`
+}
+
+// listenerConfig is a compiled Listener.
+type listenerConfig struct {
+	Listener
+	routes       routeTable
+	defaultRoute *route
+}
+
+// listenerDefinitions returns the default listener, defined by -socket and friends, followed
+// by those configured in Listeners, with names and socket permissions filled in.
+func (s *Settings) listenerDefinitions() []Listener {
+	definitions := []Listener{{
+		Name:        defaultListener,
+		Socket:      s.SocketPath,
+		SocketMode:  s.SocketMode,
+		SocketGroup: s.SocketGroup,
+		Routes:      s.Routes,
+	}}
+	for _, l := range s.Listeners {
+		if l.Name == "" {
+			l.Name = l.Socket
+		}
+		if l.SocketMode == "" {
+			l.SocketMode = s.SocketMode
+		}
+		if l.SocketGroup == "" {
+			l.SocketGroup = s.SocketGroup
+		}
+		definitions = append(definitions, l)
+	}
+	return definitions
+}
+
+// validate reports the first invalid field of l.
+func (l Listener) validate() error {
+	if l.Socket == "" {
+		return fmt.Errorf("socket: must not be empty")
+	}
+	if err := validateSocketPath(l.Socket); err != nil {
+		return fmt.Errorf("socket: %s", err)
+	}
+	if l.Name == defaultListener {
+		return fmt.Errorf("name: %q is reserved for -socket", defaultListener)
+	}
+	if _, err := parseSocketMode(l.SocketMode); err != nil {
+		return fmt.Errorf("socket-mode: %s", err)
+	}
+	defaultRoute := Route{Host: "*", Scheme: l.Scheme, Port: l.Port, ClientTimeout: l.ClientTimeout,
+		AllowUIDs: l.AllowUIDs, AllowGIDs: l.AllowGIDs}
+	if err := defaultRoute.validate(); err != nil {
+		return err
+	}
+	for i, r := range l.Routes {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("routes[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// validateListeners checks Listeners and that no two listeners share a name or socket.
+func (s *Settings) validateListeners() error {
+	for i, l := range s.Listeners {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listeners[%d]: %s", i, err)
+		}
+	}
+	names := make(map[string]bool)
+	sockets := make(map[string]bool)
+	for i, l := range s.listenerDefinitions() {
+		if names[l.Name] {
+			return fmt.Errorf("listeners[%d]: name: %q is used twice", i-1, l.Name)
+		}
+		if sockets[l.Socket] {
+			return fmt.Errorf("listeners[%d]: socket: %s is used twice", i-1, l.Socket)
+		}
+		names[l.Name], sockets[l.Socket] = true, true
+	}
+	return nil
+}
+
+// allows reports whether peer may use the listener.
+func (l Listener) allows(peer *peerCred) bool {
+	return allowedPeer(l.AllowUIDs, l.AllowGIDs, peer)
+}
+
+// newListenerConfig compiles l, using opt for options l and its routes do not set.
+func (proxy *Instance) newListenerConfig(opt Settings, l Listener, pool *transportPool) (*listenerConfig, error) {
+	if l.ClientTimeout != 0 {
+		opt.ClientTimeout = l.ClientTimeout
+	}
+	if l.Scheme != "" {
+		opt.RemoteHTTPS = l.Scheme == "https"
+	}
+	lc := &listenerConfig{Listener: l}
+	var err error
+	lc.defaultRoute, err = proxy.newRoute(opt, Route{Name: l.Name, Host: "*", Scheme: l.Scheme, Address: l.Address,
+		Port: l.Port, HostOverride: l.HostOverride}, pool)
+	if err != nil {
+		return nil, err
+	}
+	if len(l.Routes) == 0 {
+		lc.routes = routeTable{lc.defaultRoute}
+		return lc, nil
+	}
+	for i, r := range l.Routes {
+		rt, err := proxy.newRoute(opt, r, pool)
+		if err != nil {
+			return nil, fmt.Errorf("routes[%d]: %s", i, err)
+		}
+		lc.routes = append(lc.routes, rt)
+	}
+	return lc, nil
+}
+
+// listener returns the configuration of the listener r arrived on.
+func (cfg *runtimeConfig) listener(r *http.Request) *listenerConfig {
+	if lc, ok := cfg.listeners[requestListener(r)]; ok {
+		return lc
+	}
+	return cfg.listeners[defaultListener]
+}
+
+// socketListener is a listening socket and the name and path of the listener it serves.
+// For -listen-tcp, path is the TCP address.
+type socketListener struct {
+	net.Listener
+	name    string
+	path    string
+	systemd bool // the socket file belongs to systemd
+	tcp     bool
+}
+
+// acquireListeners returns a listening socket for every listener definition: inherited from a
+// process running Upgrade(), passed by systemd or newly created.
+func (proxy *Instance) acquireListeners() (listeners []*socketListener, err error) {
+	var inherited, activated map[string]*socketListener
+	defer func() {
+		for _, unused := range []map[string]*socketListener{inherited, activated} {
+			for path, l := range unused {
+				if err == nil {
+					log.Printf("closing socket %s, which is not configured", path)
+				}
+				l.Close()
+			}
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+	if inherited, err = inheritedListeners(); err != nil {
+		return nil, err
+	}
+	if activated, err = systemdListeners(proxy.sockets); err != nil {
+		return nil, err
+	}
+
+	for _, definition := range proxy.sockets {
+		l := inherited[definition.Socket]
+		if l != nil {
+			log.Printf("serving %s inherited from previous process", definition.Socket)
+			delete(inherited, definition.Socket)
+		} else if l = activated[definition.Socket]; l != nil {
+			log.Printf("serving %s passed by systemd", definition.Socket)
+			delete(activated, definition.Socket)
+		} else {
+			unixListener, err := proxy.listen(definition)
+			if err != nil {
+				if definition.Name != defaultListener {
+					err = fmt.Errorf("listener %q: %s", definition.Name, err)
+				}
+				return listeners, err
+			}
+			l = &socketListener{Listener: unixListener, path: definition.Socket}
+		}
+		l.name = definition.Name
+		listeners = append(listeners, l)
+	}
+
+	if address := proxy.Options.ListenTCP; address != "" {
+		l := inherited[address]
+		if l != nil {
+			delete(inherited, address)
+		} else if l = activated[address]; l != nil {
+			delete(activated, address)
+		} else {
+			tcpListener, err := net.Listen("tcp", address)
+			if err != nil {
+				return listeners, fmt.Errorf("listen-tcp: %s", err)
+			}
+			l = &socketListener{Listener: tcpListener, path: address}
+		}
+		log.Printf("serving HTTP proxy clients on %s", l.Addr())
+		l.name, l.tcp = defaultListener, true
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -12,16 +15,33 @@ import (
 func accessLogHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		o := &responseObserver{ResponseWriter: w}
-		h.ServeHTTP(o, r)
-		log.Printf("%q %d %d %q %q",
+		entry := &accessLogEntry{upstreamProto: "-"}
+		h.ServeHTTP(o, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+		log.Printf("%q %d %d %q %q %s upstream=%s",
 			fmt.Sprintf("%s %s %s", r.Method, r.URL, r.Proto),
 			o.status,
 			o.written,
 			r.Referer(),
-			r.UserAgent())
+			r.UserAgent(),
+			requestPeer(r),
+			entry.upstreamProto)
 	})
 }
 
+type accessLogKey struct{}
+
+// accessLogEntry collects details of a request only known to the proxy handler.
+type accessLogEntry struct {
+	upstreamProto string
+}
+
+// logUpstreamProtocol notes the protocol used upstream for r, e.g. HTTP/2.0, in the access log.
+func logUpstreamProtocol(r *http.Request, proto string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.upstreamProto = proto
+	}
+}
+
 type responseObserver struct {
 	http.ResponseWriter
 	status      int
@@ -46,3 +66,27 @@ func (o *responseObserver) WriteHeader(code int) {
 	o.wroteHeader = true
 	o.status = code
 }
+
+func (o *responseObserver) Flush() {
+	if !o.wroteHeader {
+		o.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := o.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (o *responseObserver) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := o.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", o.ResponseWriter)
+	}
+	return hijacker.Hijack()
+}
+
+func (o *responseObserver) CloseNotify() <-chan bool {
+	if notifier, ok := o.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
@@ -2,7 +2,10 @@ package proxy
 
 import (
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -11,18 +14,38 @@ import (
 type appMetrics struct {
 	enabled          bool
 	RequestsCounter  *prometheus.CounterVec
-	RequestsInflight prometheus.Gauge
+	RequestsInflight *prometheus.GaugeVec
 	RequestsDuration *prometheus.HistogramVec
 	RequestsSize     *prometheus.HistogramVec
+	TunnelsInflight  *prometheus.GaugeVec
+	TunnelsDuration  *prometheus.HistogramVec
+	TunnelBytes      *prometheus.CounterVec
+	DNSLatency       *prometheus.HistogramVec
+	DNSCacheLookups  *prometheus.CounterVec
+	TLSLatency       *prometheus.HistogramVec
+	ConfigReloads    *prometheus.CounterVec
+	PeerRequests     *prometheus.CounterVec
+	UpstreamRequests *prometheus.CounterVec
+	GRPCRequests     *prometheus.CounterVec
+	Retries          *prometheus.CounterVec
+	BreakerState     *prometheus.GaugeVec
+	HedgesSent       *prometheus.CounterVec
+	HedgesWon        *prometheus.CounterVec
+	Throttled        *prometheus.CounterVec
+	ConcurrencyLimit *prometheus.GaugeVec
+	QueueDepth       *prometheus.GaugeVec
+	QueueWait        *prometheus.HistogramVec
+	QueueRejections  *prometheus.CounterVec
+	CertExpiry       *certExpiryCollector
 }
 
 func (proxy *Instance) setupMetrics() {
 	proxy.metrics.RequestsCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "udsproxy_http_requests_total",
-			Help: "How many requests processed, partitioned by status code and HTTP method.",
+			Help: "How many requests processed, partitioned by listener, status code and HTTP method.",
 		},
-		[]string{"code", "method"},
+		[]string{"listener", "code", "method"},
 	)
 
 	rqDurationHistogramOpts := prometheus.HistogramOpts{
@@ -33,15 +56,15 @@ func (proxy *Instance) setupMetrics() {
 	}
 	proxy.metrics.RequestsDuration = prometheus.NewHistogramVec(
 		rqDurationHistogramOpts,
-		[]string{"method"},
+		[]string{"listener", "method"},
 	)
 
-	proxy.metrics.RequestsInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+	proxy.metrics.RequestsInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "udsproxy",
 		Subsystem: "http",
 		Name:      "inflight",
 		Help:      "Number of requests being actively processed",
-	})
+	}, []string{"listener"})
 
 	proxy.metrics.RequestsSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -49,22 +72,35 @@ func (proxy *Instance) setupMetrics() {
 			Help:    "A histogram of response sizes for requests.",
 			Buckets: []float64{500, 1000, 2500, 5000},
 		},
-		[]string{},
+		[]string{"listener"},
 	)
 
-	prometheus.MustRegister(
-		proxy.metrics.RequestsDuration,
-		proxy.metrics.RequestsInflight,
-		proxy.metrics.RequestsCounter,
-		proxy.metrics.RequestsSize,
+	proxy.metrics.TunnelsInflight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udsproxy_tunnels_inflight",
+			Help: "Number of tunnelled connections (e.g. WebSocket upgrades) currently open.",
+		},
+		[]string{"kind"},
 	)
-	proxy.metrics.enabled = true
-}
 
-func getTracingRoundTripper(transport *http.Transport) http.RoundTripper {
-	// copy-pasta from
-	// https://github.com/prometheus/client_golang/blob/master/prometheus/promhttp/instrument_client_test.go
-	dnsLatencyVec := prometheus.NewHistogramVec(
+	proxy.metrics.TunnelsDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "udsproxy_tunnel_duration_seconds",
+			Help:    "A histogram of lifetimes of tunnelled connections.",
+			Buckets: []float64{1, 10, 60, 300, 1800, 3600},
+		},
+		[]string{"kind"},
+	)
+
+	proxy.metrics.TunnelBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_tunnel_bytes_total",
+			Help: "Bytes transferred through tunnelled connections, partitioned by direction.",
+		},
+		[]string{"kind", "direction"},
+	)
+
+	proxy.metrics.DNSLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "udsproxy_dns_duration_seconds",
 			Help:    "Trace dns latency histogram.",
@@ -72,7 +108,16 @@ func getTracingRoundTripper(transport *http.Transport) http.RoundTripper {
 		},
 		[]string{"event"},
 	)
-	tlsLatencyVec := prometheus.NewHistogramVec(
+
+	proxy.metrics.DNSCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_dns_cache_lookups_total",
+			Help: "Upstream host lookups by -dns-cache, partitioned by result (hit, miss or stale).",
+		},
+		[]string{"result"},
+	)
+
+	proxy.metrics.TLSLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "udsproxy_tls_duration_seconds",
 			Help:    "Trace tls latency histogram.",
@@ -80,26 +125,245 @@ func getTracingRoundTripper(transport *http.Transport) http.RoundTripper {
 		},
 		[]string{"event"},
 	)
+
+	proxy.metrics.ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_config_reloads_total",
+			Help: "Configuration reloads (SIGHUP), partitioned by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+
+	proxy.metrics.UpstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_upstream_requests_total",
+			Help: "Requests answered by upstreams per listener and route, partitioned by negotiated protocol.",
+		},
+		[]string{"listener", "route", "protocol"},
+	)
+
+	proxy.metrics.GRPCRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_grpc_requests_total",
+			Help: "gRPC calls per listener and route, partitioned by gRPC status (e.g. OK, UNAVAILABLE).",
+		},
+		[]string{"listener", "route", "grpc_code"},
+	)
+
+	proxy.metrics.Retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_retries_total",
+			Help: "Upstream requests repeated after failing without a response, by route.",
+		},
+		[]string{"route"},
+	)
+
+	proxy.metrics.BreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udsproxy_circuit_breaker_state",
+			Help: "State of the circuit breaker per upstream host:port: 0 closed, 1 half-open, 2 open.",
+		},
+		[]string{"upstream"},
+	)
+
+	proxy.metrics.HedgesSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_hedges_sent_total",
+			Help: "Second attempts sent for requests not answered within the hedge delay, by route.",
+		},
+		[]string{"route"},
+	)
+
+	proxy.metrics.HedgesWon = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_hedges_won_total",
+			Help: "Hedged requests answered by the second attempt, by route.",
+		},
+		[]string{"route"},
+	)
+
+	proxy.metrics.Throttled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_throttled_requests_total",
+			Help: "Requests exceeding a route's rate limit, partitioned by result (delayed or rejected).",
+		},
+		[]string{"route", "result"},
+	)
+
+	proxy.metrics.ConcurrencyLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udsproxy_concurrency_limit",
+			Help: "Current concurrency limit per upstream host:port, as adapted in aimd or gradient mode.",
+		},
+		[]string{"upstream"},
+	)
+
+	proxy.metrics.QueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "udsproxy_concurrency_queue_depth",
+			Help: "Requests waiting for the concurrency limit per upstream host:port.",
+		},
+		[]string{"upstream"},
+	)
+
+	proxy.metrics.QueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "udsproxy_concurrency_queue_wait_seconds",
+			Help:    "A histogram of the time requests waited for the concurrency limit per upstream host:port.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+		},
+		[]string{"upstream"},
+	)
+
+	proxy.metrics.QueueRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "udsproxy_concurrency_rejected_total",
+			Help: "Requests rejected by the concurrency limit per upstream host:port, by reason (queue-full or queue-timeout).",
+		},
+		[]string{"upstream", "reason"},
+	)
+
+	if proxy.Options.MetricsPeerUID {
+		proxy.metrics.PeerRequests = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "udsproxy_peer_requests_total",
+				Help: "Requests per listener and route, partitioned by the user id of the client process.",
+			},
+			[]string{"uid", "listener", "route"},
+		)
+		prometheus.MustRegister(proxy.metrics.PeerRequests)
+	}
+
+	proxy.metrics.CertExpiry = &certExpiryCollector{
+		proxy: proxy,
+		desc: prometheus.NewDesc(
+			"udsproxy_upstream_cert_expiry_timestamp_seconds",
+			"Expiry (Unix time) of client certificates used for upstream connections, by certificate file.",
+			[]string{"cert"}, nil,
+		),
+	}
+
+	prometheus.MustRegister(
+		proxy.metrics.RequestsDuration,
+		proxy.metrics.RequestsInflight,
+		proxy.metrics.RequestsCounter,
+		proxy.metrics.RequestsSize,
+		proxy.metrics.TunnelsInflight,
+		proxy.metrics.TunnelsDuration,
+		proxy.metrics.TunnelBytes,
+		proxy.metrics.DNSLatency,
+		proxy.metrics.DNSCacheLookups,
+		proxy.metrics.TLSLatency,
+		proxy.metrics.ConfigReloads,
+		proxy.metrics.UpstreamRequests,
+		proxy.metrics.GRPCRequests,
+		proxy.metrics.Retries,
+		proxy.metrics.BreakerState,
+		proxy.metrics.HedgesSent,
+		proxy.metrics.HedgesWon,
+		proxy.metrics.Throttled,
+		proxy.metrics.ConcurrencyLimit,
+		proxy.metrics.QueueDepth,
+		proxy.metrics.QueueWait,
+		proxy.metrics.QueueRejections,
+		proxy.metrics.CertExpiry,
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	proxy.metricsServer = &http.Server{Handler: mux}
+	proxy.metrics.enabled = true
+}
+
+// tracingRoundTripper wraps transport to observe DNS and TLS latencies.
+func (m *appMetrics) tracingRoundTripper(transport http.RoundTripper) http.RoundTripper {
+	// copy-pasta from
+	// https://github.com/prometheus/client_golang/blob/master/prometheus/promhttp/instrument_client_test.go
 	trace := &promhttp.InstrumentTrace{
 		DNSStart: func(t float64) {
-			dnsLatencyVec.WithLabelValues("dns_start").Observe(t)
+			m.DNSLatency.WithLabelValues("dns_start").Observe(t)
 		},
 		DNSDone: func(t float64) {
-			dnsLatencyVec.WithLabelValues("dns_done").Observe(t)
+			m.DNSLatency.WithLabelValues("dns_done").Observe(t)
 		},
 		TLSHandshakeStart: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_start").Observe(t)
+			m.TLSLatency.WithLabelValues("tls_handshake_start").Observe(t)
 		},
 		TLSHandshakeDone: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_done").Observe(t)
+			m.TLSLatency.WithLabelValues("tls_handshake_done").Observe(t)
 		},
 	}
-	prometheus.MustRegister(tlsLatencyVec, dnsLatencyVec)
 	return promhttp.InstrumentRoundTripperTrace(trace, transport)
 }
 
 func (proxy *Instance) startPrometheusMetricsServer() {
 	log.Printf("Prometheus : http://localhost%s/metrics", proxy.Options.PrometheusPort)
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(proxy.Options.PrometheusPort, nil))
+	listener, err := net.Listen("tcp", proxy.Options.PrometheusPort)
+	// during Upgrade(), the previous process releases the port only after handing over
+	for deadline := time.Now().Add(upgradeReadyTimeout); err != nil && proxy.inherited && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		listener, err = net.Listen("tcp", proxy.Options.PrometheusPort)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = proxy.metricsServer.Serve(listener); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// certExpiryCollector exports the expiry of the client certificates currently configured. As certificate
+// files are checked for changes on collection, renewals show up without waiting for upstream traffic.
+type certExpiryCollector struct {
+	proxy *Instance
+	desc  *prometheus.Desc
+}
+
+func (c *certExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *certExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	seen := make(map[string]bool) // a certificate file may be paired with several key files
+	for _, certificate := range c.proxy.runtime().pool.certificates {
+		if seen[certificate.certFile] {
+			continue
+		}
+		seen[certificate.certFile] = true
+		notAfter := certificate.current().Leaf.NotAfter
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(notAfter.Unix()), certificate.certFile)
+	}
+}
+
+// countUpstreamResponse records the protocol of an upstream's response to r in metrics and access log.
+func (proxy *Instance) countUpstreamResponse(r *http.Request, listener, route string, response *http.Response) {
+	logUpstreamProtocol(r, response.Proto)
+	if proxy.metrics.enabled {
+		proxy.metrics.UpstreamRequests.WithLabelValues(listener, route, response.Proto).Inc()
+	}
+}
+
+// countGRPCResponse counts a gRPC call by its status once the upstream's response has been consumed.
+func (proxy *Instance) countGRPCResponse(listener, route string, response *http.Response) {
+	if proxy.metrics.enabled && isGRPC(response.Header) {
+		proxy.metrics.GRPCRequests.WithLabelValues(listener, route, grpcStatus(response)).Inc()
+	}
+}
+
+// countThrottledRequest counts a request exceeding route's rate limit.
+func (proxy *Instance) countThrottledRequest(route, result string) {
+	if proxy.metrics.enabled {
+		proxy.metrics.Throttled.WithLabelValues(route, result).Inc()
+	}
+}
+
+// countPeerRequest counts a request by peer to route if -metrics-peer-uid is enabled.
+func (proxy *Instance) countPeerRequest(peer *peerCred, listener, route string) {
+	if proxy.metrics.PeerRequests == nil {
+		return
+	}
+	uid := "unknown"
+	if peer != nil {
+		uid = strconv.Itoa(peer.uid)
+	}
+	proxy.metrics.PeerRequests.WithLabelValues(uid, listener, route).Inc()
 }
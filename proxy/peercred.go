@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// peerCred identifies the process connected to the socket, as reported by the kernel.
+type peerCred struct {
+	uid, gid, pid int
+}
+
+type peerCredKey struct{}
+
+type listenerKey struct{}
+
+// connContext is the http.Server's ConnContext hook and attaches the name of the listener and
+// the peer's credentials to the context of all requests read from conn.
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if tracked, ok := conn.(*trackedConn); ok {
+		ctx = context.WithValue(ctx, listenerKey{}, tracked.listener)
+		conn = tracked.Conn
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := peerCredentials(unixConn)
+	if err != nil {
+		log.Printf("cannot read peer credentials: %s", err)
+		return ctx
+	}
+	if cred == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// requestPeer returns the credentials of the process that sent r, or nil if unknown.
+func requestPeer(r *http.Request) *peerCred {
+	cred, _ := r.Context().Value(peerCredKey{}).(*peerCred)
+	return cred
+}
+
+// requestListener returns the name of the listener r arrived on.
+func requestListener(r *http.Request) string {
+	if name, ok := r.Context().Value(listenerKey{}).(string); ok {
+		return name
+	}
+	return defaultListener
+}
+
+func (c *peerCred) String() string {
+	if c == nil {
+		return "uid=- gid=- pid=-"
+	}
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", c.uid, c.gid, c.pid)
+}
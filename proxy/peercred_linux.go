@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials reads the credentials of the process connected to conn (SO_PEERCRED).
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	controlErr := rawConn.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &peerCred{uid: int(ucred.Uid), gid: int(ucred.Gid), pid: int(ucred.Pid)}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import "net"
+
+// peerCredentials is only implemented on Linux; elsewhere, peers remain anonymous
+// and routes restricted by allow-uids or allow-gids deny all requests.
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	return nil, nil
+}
@@ -6,18 +6,20 @@ pooling. Optionally, the proxy can expose metrics via prometheus client library.
 package proxy
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -25,28 +27,103 @@ import (
 var AppVersion = "0.8.x-dev"
 
 // Instance provides state storage for a single proxy instance.
+// Options and HTTPClient reflect the configuration the instance was started with and are not changed
+// by Reload(); use CurrentOptions() and CurrentHTTPClient() for the configuration currently in use.
 type Instance struct {
 	Options    Settings
 	HTTPClient *http.Client
-	metrics    appMetrics
+	// ConfigLoader, if set, provides the Settings to apply when Reload() is called.
+	ConfigLoader    func() (Settings, error)
+	metrics         appMetrics
+	dnsCache        *dnsCache // shared by the resolvers of all configurations, see -dns-cache
+	breakers        *circuitBreakers
+	rateLimits      *rateLimits
+	limiters        *concurrencyLimiters
+	config          atomic.Value // *runtimeConfig
+	reloadMutex     sync.Mutex
+	initialSettings Settings
+	server          *http.Server
+	openConns       int64 // accepted client connections not closed yet; accessed atomically
+	idleConns       int64 // open connections waiting for further requests; accessed atomically
+	draining        int32 // set once drain() started; accessed atomically
+	tunnels         map[net.Conn]struct{}
+	tunnelsMutex    sync.Mutex
+	shutdownOnce    sync.Once
+	shutdownDone    chan struct{}
+	sockets         []Listener // listener definitions, see Settings.listenerDefinitions()
+	listeners       []*socketListener
+	listenerMutex   sync.Mutex
+	serveDone       chan struct{}
+	handedOver      bool // sockets and pid file belong to the process started by Upgrade()
+	inherited       bool // sockets were handed over by a process running Upgrade()
+	metricsServer   *http.Server
 }
 
 // Settings configure a Instance and need to be passed to NewProxyInstance().
+// Options can also be read from configuration files and environment variables, see LoadSettings().
 type Settings struct {
-	SocketPath          string
-	PidFile             string
-	PrometheusPort      string
-	ClientTimeout       int
-	MaxConnsPerHost     int
-	MaxIdleConns        int
-	MaxIdleConnsPerHost int
-	IdleConnTimeout     int
-	SocketReadTimeout   int
-	SocketWriteTimeout  int
-	PrintVersion        bool
-	NoLogTimeStamps     bool
-	NoAccessLog         bool
-	RemoteHTTPS         bool
+	SocketPath             string            `json:"socket"`
+	SocketMode             string            `json:"socket-mode"`
+	SocketGroup            string            `json:"socket-group"`
+	SocketCreateDir        bool              `json:"socket-create-dir"`
+	SocketH2C              bool              `json:"socket-h2c"`
+	ListenTCP              string            `json:"listen-tcp"`
+	PidFile                string            `json:"pid-file"`
+	PrometheusPort         string            `json:"prometheus-port"`
+	ClientTimeout          int               `json:"client-timeout"`
+	MaxConnsPerHost        int               `json:"max-conns-per-host"`
+	MaxIdleConns           int               `json:"max-idle-conns"`
+	MaxIdleConnsPerHost    int               `json:"max-idle-conns-per-host"`
+	IdleConnTimeout        int               `json:"idle-timeout"`
+	SocketReadTimeout      int               `json:"socket-read-timeout"`
+	SocketWriteTimeout     int               `json:"socket-write-timeout"`
+	FlushInterval          int               `json:"flush-interval"`
+	ShutdownTimeout        int               `json:"shutdown-timeout"`
+	PrintVersion           bool              `json:"-"`
+	NoLogTimeStamps        bool              `json:"no-log-timestamps"`
+	NoAccessLog            bool              `json:"no-access-log"`
+	MetricsPeerUID         bool              `json:"metrics-peer-uid"`
+	RemoteHTTPS            bool              `json:"remote-https"`
+	TLSCert                string            `json:"tls-cert"`
+	TLSKey                 string            `json:"tls-key"`
+	TLSCA                  string            `json:"tls-ca"`
+	TLSMinVersion          string            `json:"tls-min-version"`
+	TLSCipherSuites        string            `json:"tls-cipher-suites"`
+	UpstreamProtocol       string            `json:"upstream-protocol"`
+	H2MaxConcurrentStreams int               `json:"h2-max-concurrent-streams"`
+	H2PingInterval         int               `json:"h2-ping-interval"`
+	H2PingTimeout          int               `json:"h2-ping-timeout"`
+	Retries                int               `json:"retries"`
+	RetryBackoff           int               `json:"retry-backoff"`
+	RetryBufferSize        int               `json:"retry-buffer-size"`
+	BreakerFailures        int               `json:"breaker-failures"`
+	BreakerErrorRate       int               `json:"breaker-error-rate"`
+	BreakerTimeoutRate     int               `json:"breaker-timeout-rate"`
+	BreakerMinRequests     int               `json:"breaker-min-requests"`
+	BreakerWindow          int               `json:"breaker-window"`
+	BreakerOpenTime        int               `json:"breaker-open-time"`
+	HedgePercentile        int               `json:"hedge-percentile"`
+	HedgeBudget            int               `json:"hedge-budget"`
+	HedgeMinDelay          int               `json:"hedge-min-delay"`
+	RateLimit              string            `json:"rate-limit"`
+	RateLimitBurst         int               `json:"rate-limit-burst"`
+	RateLimitKey           string            `json:"rate-limit-key"`
+	RateLimitMode          string            `json:"rate-limit-mode"`
+	RateLimitQueueTimeout  int               `json:"rate-limit-queue-timeout"`
+	RateLimitMaxPause      int               `json:"rate-limit-max-pause"`
+	MaxConcurrency         int               `json:"max-concurrency"`
+	ConcurrencyQueue       int               `json:"concurrency-queue"`
+	ConcurrencyTimeout     int               `json:"concurrency-timeout"`
+	ConcurrencyMode        string            `json:"concurrency-mode"`
+	DNSCache               bool              `json:"dns-cache"`
+	DNSServers             string            `json:"dns-servers"`
+	DNSStaleTTL            int               `json:"dns-stale-ttl"`
+	HostOverrides          map[string]string `json:"host-overrides"`
+	LogHostOverrides       bool              `json:"log-host-overrides"`
+	ConnectPorts           string            `json:"connect-ports"`
+	RoutesFile             string            `json:"routes-file"`
+	Routes                 []Route           `json:"routes"`
+	Listeners              []Listener        `json:"listeners"`
 }
 
 // NewProxyInstance validates supplied Settings and returns a ready-to-run proxy instance.
@@ -55,133 +132,444 @@ func NewProxyInstance(args Settings) *Instance {
 		println("uds-proxy", AppVersion, runtime.Version())
 		os.Exit(0)
 	}
-	if args.SocketPath == "" {
-		println("Error: -socket must be provided, use -h for help")
-		os.Exit(1)
-	}
 	if args.NoLogTimeStamps {
 		log.SetFlags(0)
 	}
-	log.Printf("👋 uds-proxy %s, pid %d starting...", AppVersion, os.Getpid())
 
-	writePidFile(args.PidFile)
-
-	proxyInstance := Instance{}
-	proxyInstance.Options = args
+	proxyInstance := Instance{
+		Options:         args,
+		initialSettings: args,
+		tunnels:         make(map[net.Conn]struct{}),
+		shutdownDone:    make(chan struct{}),
+		serveDone:       make(chan struct{}),
+		sockets:         args.listenerDefinitions(),
+		inherited:       os.Getenv(envListenFDs) != "",
+	}
 	if args.PrometheusPort != "" {
 		proxyInstance.setupMetrics()
 	}
-	proxyInstance.HTTPClient = newHTTPClient(&proxyInstance.Options, proxyInstance.metrics.enabled)
+	proxyInstance.dnsCache = newDNSCache(&proxyInstance.metrics)
+	proxyInstance.breakers = newCircuitBreakers(&proxyInstance.metrics)
+	proxyInstance.rateLimits = newRateLimits()
+	proxyInstance.limiters = newConcurrencyLimiters(&proxyInstance.metrics)
+	cfg, err := proxyInstance.newRuntimeConfig(args)
+	if err != nil {
+		println("Error:", err.Error()+", use -h for help")
+		os.Exit(1)
+	}
+	proxyInstance.config.Store(cfg)
+	proxyInstance.Options, proxyInstance.HTTPClient = cfg.options, cfg.httpClient // with the routes of routes-file
+	proxyInstance.server = proxyInstance.newSocketServer()
+	log.Printf("👋 uds-proxy %s, pid %d starting...", AppVersion, os.Getpid())
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
 	go sigHandler(c, &proxyInstance)
 
 	return &proxyInstance
 }
 
 // Run starts the proxy's socket server accept loop, which will run until Shutdown() is called.
-func (proxy *Instance) Run() {
+// It returns nil once Shutdown() has completed, or an error if the socket cannot be served.
+func (proxy *Instance) Run() error {
 	if proxy.metrics.enabled {
 		go proxy.startPrometheusMetricsServer()
 	}
-	proxy.startSocketServerAcceptLoop()
+	err := proxy.startSocketServerAcceptLoop()
+	if err == http.ErrServerClosed {
+		<-proxy.shutdownDone
+		return nil
+	}
+	return err
 }
 
 // Shutdown cleanly terminates a proxy instance (and is invoked by signal handlers or during tests).
+// It stops accepting connections, then waits up to -shutdown-timeout for requests in flight to
+// complete before aborting the remaining ones.
 func (proxy *Instance) Shutdown(sig os.Signal) {
-	if sig == nil {
-		sig = os.Interrupt
-	}
-	log.Printf("%v -- cleaning up", sig)
-	proxy.HTTPClient.CloseIdleConnections()
-	os.Remove(proxy.Options.SocketPath)
-	os.Remove(proxy.Options.PidFile)
-	log.Print("uds-proxy shut down cleanly. nice. good bye 👋")
+	proxy.shutdownOnce.Do(func() {
+		if sig == nil {
+			sig = os.Interrupt
+		}
+		log.Printf("%v -- cleaning up", sig)
+		if !proxy.handedOver {
+			sdNotify("STOPPING=1")
+		}
+		proxy.drain(time.Duration(proxy.runtime().options.ShutdownTimeout) * time.Millisecond)
+		proxy.runtime().closeIdleConnections()
+		if proxy.metricsServer != nil {
+			proxy.metricsServer.Close()
+		}
+		if !proxy.handedOver {
+			for _, l := range proxy.listeners {
+				if !l.systemd && !l.tcp && !isAbstractSocket(l.path) {
+					os.Remove(l.path)
+				}
+			}
+			os.Remove(proxy.Options.PidFile)
+		}
+		log.Print("uds-proxy shut down cleanly. nice. good bye 👋")
+		close(proxy.shutdownDone)
+	})
 }
 
-func (proxy *Instance) startSocketServerAcceptLoop() {
-	if _, err := os.Stat(proxy.Options.SocketPath); err == nil {
-		err := os.Remove(proxy.Options.SocketPath)
-		if err != nil {
-			panic(err)
+// drain closes the listener and waits for requests in flight, aborting them after timeout.
+// http.Server.Shutdown() is not used to stop accepting since it drops connections whose request
+// has not been read yet; instead, keep-alives are disabled so that connections close once served.
+// Idle HTTP/2 connections do not close that way, they are left to Shutdown(), which sends GOAWAY.
+func (proxy *Instance) drain(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	atomic.StoreInt32(&proxy.draining, 1)
+	proxy.server.SetKeepAlivesEnabled(false)
+	proxy.listenerMutex.Lock()
+	listeners := proxy.listeners
+	proxy.listenerMutex.Unlock()
+	if listeners != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		// once Serve() returned, no Accept() is pending and openConns is complete
+		select {
+		case <-proxy.serveDone:
+		case <-ctx.Done():
 		}
 	}
+	var err error
+	for err == nil && atomic.LoadInt64(&proxy.openConns) > atomic.LoadInt64(&proxy.idleConns) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err == nil {
+		proxy.server.Shutdown(ctx)
+		return
+	}
+	if aborted := atomic.LoadInt64(&proxy.openConns); aborted > 0 {
+		log.Printf("shutdown timeout of %s exceeded, aborting %d connection(s) in flight", timeout, aborted)
+	}
+	proxy.server.Close()
+	proxy.closeTunnels()
+}
 
-	server := http.Server{
+func (proxy *Instance) newSocketServer() *http.Server {
+	server := &http.Server{
 		ReadTimeout:  time.Duration(proxy.Options.SocketReadTimeout) * time.Millisecond,
 		WriteTimeout: time.Duration(proxy.Options.SocketWriteTimeout) * time.Millisecond,
-		Handler:      http.HandlerFunc(proxy.handleProxyRequest)}
+		Handler:      http.HandlerFunc(proxy.handleProxyRequest),
+		ConnContext:  connContext,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if tracked, ok := conn.(*trackedConn); ok {
+				tracked.setIdle(state == http.StateIdle)
+			}
+		},
+	}
+	if proxy.Options.SocketH2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	if proxy.metrics.enabled {
-		server.Handler = promhttp.InstrumentHandlerInFlight(proxy.metrics.RequestsInflight,
-			promhttp.InstrumentHandlerCounter(proxy.metrics.RequestsCounter,
-				promhttp.InstrumentHandlerDuration(proxy.metrics.RequestsDuration,
-					promhttp.InstrumentHandlerResponseSize(proxy.metrics.RequestsSize,
-						http.HandlerFunc(proxy.handleProxyRequest)))))
+		// requests are instrumented per listener, using a handler chain with curried metrics each
+		handlers := make(map[string]http.Handler)
+		for _, l := range proxy.sockets {
+			labels := prometheus.Labels{"listener": l.Name}
+			handlers[l.Name] = promhttp.InstrumentHandlerInFlight(proxy.metrics.RequestsInflight.With(labels),
+				promhttp.InstrumentHandlerCounter(proxy.metrics.RequestsCounter.MustCurryWith(labels),
+					promhttp.InstrumentHandlerDuration(proxy.metrics.RequestsDuration.MustCurryWith(labels),
+						promhttp.InstrumentHandlerResponseSize(proxy.metrics.RequestsSize.MustCurryWith(labels),
+							http.HandlerFunc(proxy.handleProxyRequest)))))
+		}
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[requestListener(r)].ServeHTTP(w, r)
+		})
 	}
 
 	if !proxy.Options.NoAccessLog {
 		server.Handler = accessLogHandler(server.Handler)
 	}
+	server.Handler = withResponseController(server.Handler)
+	return server
+}
 
-	unixListener, err := net.Listen("unix", proxy.Options.SocketPath)
+func (proxy *Instance) startSocketServerAcceptLoop() error {
+	listeners, err := proxy.acquireListeners()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	proxy.listenerMutex.Lock()
+	proxy.listeners = listeners
+	proxy.listenerMutex.Unlock()
+
+	if err = writePidFile(proxy.Options.PidFile); err != nil {
+		log.Printf("cannot write pid file: %s", err)
+	}
+	notifyUpgradeReady()
+	proxy.notifyReady()
+
+	var serving sync.WaitGroup
+	serveErrors := make(chan error, len(listeners))
+	for _, l := range listeners {
+		serving.Add(1)
+		go func(l *socketListener) {
+			defer serving.Done()
+			serveErrors <- proxy.server.Serve(&trackingListener{Listener: l, name: l.name, open: &proxy.openConns,
+				idle: &proxy.idleConns})
+		}(l)
+	}
+	go func() {
+		serving.Wait()
+		close(proxy.serveDone)
+	}()
+	err = <-serveErrors
+	if atomic.LoadInt32(&proxy.draining) == 1 {
+		err = http.ErrServerClosed // drain() closed the listeners
 	}
-	server.Serve(unixListener)
+	return err
 }
 
 func (proxy *Instance) handleProxyRequest(clientResponseWriter http.ResponseWriter, clientRequest *http.Request) {
-	scheme := "http"
-	if proxy.Options.RemoteHTTPS {
-		scheme = "https"
+	cfg := proxy.runtime()
+	lc := cfg.listener(clientRequest)
+	peer := requestPeer(clientRequest)
+	if !lc.allows(peer) {
+		http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: listener %q denies access to %s", lc.Name, peer),
+			http.StatusForbidden)
+		return
+	}
+	if clientRequest.Method == http.MethodConnect {
+		proxy.handleConnectRequest(clientResponseWriter, clientRequest, cfg, lc)
+		return
+	}
+
+	rt := lc.routes.match(clientRequest.Host)
+	if rt == nil {
+		http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: no route for host %q", clientRequest.Host),
+			http.StatusMisdirectedRequest)
+		return
+	}
+	if !rt.allows(peer) {
+		http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: route %q denies access to %s", rt.Name, peer),
+			http.StatusForbidden)
+		return
+	}
+	proxy.countPeerRequest(peer, lc.Name, rt.Name)
+	targetURL := rt.targetURL(clientRequest)
 
+	if isUpgradeRequest(clientRequest) {
+		proxy.handleUpgradeRequest(clientResponseWriter, clientRequest, rt, targetURL)
+		return
 	}
-	targetURL := fmt.Sprintf("%s://%s%s", scheme, clientRequest.Host, clientRequest.URL)
 
-	backendRequest, err := http.NewRequest(clientRequest.Method, targetURL, clientRequest.Body)
+	ctx, deadline, cancel := withUpstreamDeadline(clientRequest.Context(), rt.timeout)
+	defer cancel()
+	backendRequest, err := http.NewRequestWithContext(ctx, clientRequest.Method, targetURL, clientRequest.Body)
 	if err != nil {
 		http.Error(clientResponseWriter, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	backendRequest.Header = clientRequest.Header
+	backendRequest.ContentLength = clientRequest.ContentLength
+	copyHeader(backendRequest.Header, clientRequest.Header)
+	removeHopByHopHeaders(backendRequest.Header)
+	if headerHasToken(clientRequest.Header, "Te", "trailers") {
+		backendRequest.Header.Set("Te", "trailers")
+	}
 	backendRequest.Header.Set("X-Request-Via", "uds-proxy")
+	rt.setBackendHost(backendRequest, clientRequest)
+
+	var bucket *tokenBucket
+	if rt.rateLimit.enabled() {
+		bucket = proxy.rateLimits.get(rt.Name, rt.rateLimit.bucketKey(clientRequest, peer), rt.rateLimit)
+		if !proxy.waitForRateLimit(clientResponseWriter, clientRequest, rt, bucket) {
+			return
+		}
+	}
 
-	backendResponse, err := proxy.HTTPClient.Do(backendRequest)
+	var limiter *concurrencyLimiter
+	if rt.concurrency.enabled() {
+		limiter = proxy.limiters.get(backendRequest.URL.Host, rt.concurrency)
+		if err := limiter.acquire(clientRequest, rt.concurrency); err != nil {
+			http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: concurrency limit of %s reached: %s",
+				backendRequest.URL.Host, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	var ticket *breakerTicket
+	if rt.breaker.enabled() {
+		allowed, state, reason, retryAfter := proxy.breakers.get(backendRequest.URL.Host).allow(rt.breaker)
+		if allowed == nil {
+			limiter.release()
+			clientResponseWriter.Header().Set("X-Circuit-Breaker", state)
+			clientResponseWriter.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: circuit breaker for %s is %s: %s",
+				backendRequest.URL.Host, state, reason), http.StatusServiceUnavailable)
+			return
+		}
+		ticket = allowed
+	}
+
+	if bucket != nil || limiter != nil {
+		backendRequest = withHedgeLimits(backendRequest, &hedgeLimits{bucket, rt.rateLimit, limiter})
+	}
+	if isStreamingRequest(clientRequest) {
+		if err := liftReadDeadline(clientResponseWriter, clientRequest); err != nil {
+			log.Printf("streaming request: cannot lift socket-read-timeout: %s", err)
+		}
+	}
+	start := time.Now()
+	backendResponse, err := rt.client.Do(backendRequest)
+	latency, outcome := time.Since(start), upstreamOutcome(backendResponse, err)
+	switch {
+	case err != nil && deadline.wasExceeded():
+		outcome = outcomeTimeout
+	case err != nil && clientRequest.Context().Err() != nil:
+		outcome = outcomeCancelled
+	}
+	recordOutcome(ticket, rt.breaker, outcome)
+	defer limiter.done(rt.concurrency, latency, outcome) // once the response has been streamed
 	if err != nil {
-		if err.(*url.Error).Timeout() {
-			http.Error(clientResponseWriter, err.Error(), http.StatusGatewayTimeout)
+		if outcome == outcomeTimeout {
+			http.Error(clientResponseWriter, fmt.Sprintf("uds-proxy: %s %s: no response within client-timeout of %s",
+				backendRequest.Method, targetURL, rt.timeout), http.StatusGatewayTimeout)
 		} else {
 			http.Error(clientResponseWriter, err.Error(), http.StatusBadGateway)
 		}
 		return
 	}
-
-	for k, v := range backendResponse.Header {
-		clientResponseWriter.Header().Set(k, v[0])
+	honourRetryAfter(bucket, rt, backendResponse)
+	if isStreamingResponse(backendResponse) {
+		deadline.lift()
+		if err := liftWriteDeadline(clientResponseWriter, clientRequest); err != nil {
+			log.Printf("streaming response: cannot lift socket-write-timeout: %s", err)
+		}
 	}
+	proxy.countUpstreamResponse(clientRequest, lc.Name, rt.Name, backendResponse)
+
+	removeHopByHopHeaders(backendResponse.Header)
+	copyHeader(clientResponseWriter.Header(), backendResponse.Header)
 	clientResponseWriter.Header().Set("X-Response-Via", "uds-proxy")
+	announcedTrailers := len(backendResponse.Trailer)
+	announceTrailers(clientResponseWriter, backendResponse)
 	clientResponseWriter.WriteHeader(backendResponse.StatusCode)
-	io.Copy(clientResponseWriter, backendResponse.Body)
+	streamResponseBody(clientResponseWriter, backendResponse, cfg.options.FlushInterval)
 	backendResponse.Body.Close()
+	copyTrailers(clientResponseWriter, backendResponse, announcedTrailers)
+	proxy.countGRPCResponse(lc.Name, rt.Name, backendResponse)
+}
+
+// transportKey holds the settings that distinguish one connection pool from another.
+type transportKey struct {
+	maxConnsPerHost, maxIdleConns, maxIdleConnsPerHost, idleConnTimeout int
+	protocol                                                            string
+	h2MaxConcurrentStreams, h2PingInterval, h2PingTimeout               int
+	tls                                                                 upstreamTLS
+}
+
+// transportPool shares transports, i.e. connection pools, among routes with identical connection
+// settings, and client certificates among transports using the same files. All transports connect
+// to upstreams using dialContext, which applies host-overrides and -dns-cache.
+type transportPool struct {
+	transports   map[transportKey]*pooledTransport
+	certificates map[[2]string]*clientCertificate // by certificate and key file
+	resolver     *dnsResolver
+	overrides    hostOverrides
+	logOverrides bool
 }
 
-func newHTTPClient(opt *Settings, metricsEnabled bool) (client *http.Client) {
-	transport := http.Transport{
+// pooledTransport is a shared transport and the round tripper requests are sent with, which
+// enforces h2-max-concurrent-streams, if set.
+type pooledTransport struct {
+	*http.Transport
+	roundTripper http.RoundTripper
+}
+
+func newTransportPool(resolver *dnsResolver, overrides hostOverrides, logOverrides bool) *transportPool {
+	return &transportPool{
+		transports:   make(map[transportKey]*pooledTransport),
+		certificates: make(map[[2]string]*clientCertificate),
+		resolver:     resolver,
+		overrides:    overrides,
+		logOverrides: logOverrides,
+	}
+}
+
+// dialContext connects to address (host:port), or to the address host-overrides pins it to. As the
+// request URL is left alone, Host header and TLS server name remain those of the original host.
+func (pool *transportPool) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if to, ok := pool.overrides.apply(address); ok {
+		if pool.logOverrides {
+			log.Printf("host override: connecting to %s instead of %s", to, address)
+		}
+		address = to
+	}
+	if pool.resolver != nil {
+		return pool.resolver.dialContext(ctx, network, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// get returns the transport for opt and TLS server name sni, creating it if necessary.
+func (pool *transportPool) get(opt *Settings, sni string) (*pooledTransport, error) {
+	key := transportKey{opt.MaxConnsPerHost, opt.MaxIdleConns, opt.MaxIdleConnsPerHost, opt.IdleConnTimeout,
+		opt.UpstreamProtocol, opt.H2MaxConcurrentStreams, opt.H2PingInterval, opt.H2PingTimeout,
+		upstreamTLS{opt.TLSCert, opt.TLSKey, opt.TLSCA, opt.TLSMinVersion, opt.TLSCipherSuites, sni}}
+	if transport, ok := pool.transports[key]; ok {
+		return transport, nil
+	}
+	tlsConfig, err := pool.tlsConfig(key.tls)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
 		MaxConnsPerHost:       opt.MaxConnsPerHost,
 		MaxIdleConns:          opt.MaxIdleConns,
 		MaxIdleConnsPerHost:   opt.MaxIdleConnsPerHost,
 		IdleConnTimeout:       time.Duration(opt.IdleConnTimeout) * time.Millisecond,
 		TLSHandshakeTimeout:   5 * time.Second,
 		ExpectContinueTimeout: 5 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           pool.dialContext,
+	}
+	configureHTTP2(transport, opt)
+	pooled := &pooledTransport{Transport: transport, roundTripper: transport}
+	if transport.Protocols != nil && opt.H2MaxConcurrentStreams > 0 {
+		pooled.roundTripper = newStreamLimiter(transport, opt.H2MaxConcurrentStreams)
+	}
+	pool.transports[key] = pooled
+	return pooled, nil
+}
+
+// newHTTPClient returns a client for route sending requests via transport, retrying and hedging them as
+// configured by opt. It has no timeout: handleProxyRequest limits each request, including all attempts,
+// to client-timeout until its response headers arrived, and non-streaming responses until they are read.
+func (proxy *Instance) newHTTPClient(opt *Settings, transport *pooledTransport, route string) (client *http.Client) {
+	roundTripper := transport.roundTripper
+	if opt.Retries > 0 {
+		retrying := &retryingTransport{transport: roundTripper, retries: opt.Retries,
+			backoff: time.Duration(opt.RetryBackoff) * time.Millisecond, bufferSize: opt.RetryBufferSize,
+			timeout: time.Duration(opt.ClientTimeout) * time.Millisecond}
+		if proxy.metrics.enabled {
+			retrying.retried = proxy.metrics.Retries.WithLabelValues(route).Inc
+		}
+		roundTripper = retrying
 	}
-	client = &http.Client{
-		Timeout:   time.Duration(opt.ClientTimeout) * time.Millisecond,
-		Transport: &transport,
+	if opt.HedgePercentile > 0 && opt.HedgeBudget > 0 {
+		hedging := &hedgingTransport{transport: roundTripper, percentile: opt.HedgePercentile,
+			budget: opt.HedgeBudget, minDelay: time.Duration(opt.HedgeMinDelay) * time.Millisecond}
+		if proxy.metrics.enabled {
+			hedging.sent = proxy.metrics.HedgesSent.WithLabelValues(route).Inc
+			hedging.won = proxy.metrics.HedgesWon.WithLabelValues(route).Inc
+		}
+		roundTripper = hedging
 	}
-	if metricsEnabled {
-		client.Transport = getTracingRoundTripper(&transport)
+	client = &http.Client{Transport: roundTripper}
+	if proxy.metrics.enabled {
+		client.Transport = proxy.metrics.tracingRoundTripper(roundTripper)
 	}
 	return
 }
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Modes of rate limits: requests exceeding a limit wait for a token or are rejected.
+const (
+	rateLimitQueue  = "queue"
+	rateLimitReject = "reject"
+)
+
+// rateLimitPolicy holds the token bucket settings of a route, see the rate-limit-* options.
+type rateLimitPolicy struct {
+	rate         float64 // tokens per second, 0 disables
+	burst        float64
+	key          string // "", "uid" or "header:<name>"
+	reject       bool
+	queueTimeout time.Duration
+	maxPause     time.Duration
+}
+
+func newRateLimitPolicy(opt *Settings) rateLimitPolicy {
+	rate, _ := parseRate(opt.RateLimit)
+	p := rateLimitPolicy{
+		rate:         rate,
+		burst:        float64(opt.RateLimitBurst),
+		key:          opt.RateLimitKey,
+		reject:       opt.RateLimitMode == rateLimitReject,
+		queueTimeout: time.Duration(opt.RateLimitQueueTimeout) * time.Millisecond,
+		maxPause:     time.Duration(opt.RateLimitMaxPause) * time.Millisecond,
+	}
+	if p.burst < 1 {
+		p.burst = 1
+	}
+	return p
+}
+
+// parseRate parses a rate limit such as "10/s", "600/m" or "5000/h" into requests per second;
+// a plain number is per second. Empty disables the limit.
+func parseRate(limit string) (float64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	count, unit := limit, "s"
+	if i := strings.IndexByte(limit, '/'); i >= 0 {
+		count, unit = limit[:i], limit[i+1:]
+	}
+	per := map[string]float64{"s": 1, "m": 60, "h": 3600}[unit]
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 || per == 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected requests per second, minute or hour, e.g. 10/s or 600/m", limit)
+	}
+	return n / per, nil
+}
+
+// validateRateLimit checks the rate-limit, rate-limit-mode and rate-limit-key options.
+func validateRateLimit(limit, mode, key string) error {
+	if _, err := parseRate(limit); err != nil {
+		return fmt.Errorf("rate-limit: %s", err)
+	}
+	if mode != "" && mode != rateLimitQueue && mode != rateLimitReject {
+		return fmt.Errorf("rate-limit-mode: must be %s or %s, got %q", rateLimitQueue, rateLimitReject, mode)
+	}
+	if key != "" && key != "uid" && (!strings.HasPrefix(key, "header:") || key == "header:") {
+		return fmt.Errorf("rate-limit-key: must be uid or header:<name>, got %q", key)
+	}
+	return nil
+}
+
+func (p rateLimitPolicy) enabled() bool {
+	return p.rate > 0
+}
+
+// bucketKey returns what the request's bucket is chosen by: the peer's uid or a header value, if configured.
+func (p rateLimitPolicy) bucketKey(request *http.Request, peer *peerCred) string {
+	switch {
+	case p.key == "uid" && peer != nil:
+		return strconv.Itoa(peer.uid)
+	case p.key == "uid":
+		return "unknown"
+	case strings.HasPrefix(p.key, "header:"):
+		return request.Header.Get(strings.TrimPrefix(p.key, "header:"))
+	}
+	return ""
+}
+
+// rateLimits holds the token buckets of all routes, by route name and bucket key. They outlive
+// configuration reloads; the policy to apply is passed by the route of each request.
+type rateLimits struct {
+	mutex   sync.Mutex
+	buckets map[[2]string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{buckets: make(map[[2]string]*tokenBucket), swept: time.Now()}
+}
+
+// get returns the bucket of route and key. Once a minute, buckets that have been idle long enough
+// to be full again are dropped, as they would not limit their next request anyway.
+func (l *rateLimits) get(route, key string, p rateLimitPolicy) *tokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > time.Minute {
+		for k, bucket := range l.buckets {
+			if bucket.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	bucket, ok := l.buckets[[2]string{route, key}]
+	if !ok {
+		bucket = &tokenBucket{tokens: p.burst, last: now, rate: p.rate, burst: p.burst}
+		l.buckets[[2]string{route, key}] = bucket
+	}
+	return bucket
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second. Requests waiting in queue mode
+// take their token in advance, leaving the bucket in debt. While paused, last lies in the future.
+// Rate and burst are those of the policy last applied.
+type tokenBucket struct {
+	mutex       sync.Mutex
+	tokens      float64
+	last        time.Time
+	rate, burst float64
+}
+
+func (b *tokenBucket) advance(p rateLimitPolicy, now time.Time) {
+	b.rate, b.burst = p.rate, p.burst
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * p.rate
+		if b.tokens > p.burst {
+			b.tokens = p.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes a token, returning how long to wait until it may be used. If the request would have to
+// wait in reject mode, or longer than rate-limit-queue-timeout in queue mode, no token is taken.
+func (b *tokenBucket) reserve(p rateLimitPolicy, now time.Time) (time.Duration, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.advance(p, now)
+	wait := b.last.Sub(now)
+	if b.tokens < 1 {
+		wait += time.Duration((1 - b.tokens) / p.rate * float64(time.Second))
+	}
+	if wait > 0 && (p.reject || wait > p.queueTimeout) {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// take takes a token if one is available without waiting.
+func (b *tokenBucket) take(p rateLimitPolicy) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.advance(p, now)
+	if b.last.After(now) || b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cancel returns the token of a request that gave up waiting.
+func (b *tokenBucket) cancel(p rateLimitPolicy) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens++; b.tokens > p.burst {
+		b.tokens = p.burst
+	}
+}
+
+// pause empties the bucket and stops refilling it until until, as asked by an upstream's Retry-After,
+// reporting whether that extends a previous pause. Requests already waiting for their token are not
+// delayed further.
+func (b *tokenBucket) pause(p rateLimitPolicy, until time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.advance(p, time.Now())
+	if !until.After(b.last) {
+		return false
+	}
+	if b.tokens > 0 {
+		b.tokens = 0
+	}
+	b.last = until
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return !b.last.After(now) && b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// waitForRateLimit takes a token from the request's bucket, waiting for it in queue mode. Requests that
+// may not be sent are answered with 429 Too Many Requests; false is returned for them and for requests
+// whose client gave up waiting.
+func (proxy *Instance) waitForRateLimit(w http.ResponseWriter, r *http.Request, rt *route, bucket *tokenBucket) bool {
+	wait, ok := bucket.reserve(rt.rateLimit, time.Now())
+	if !ok {
+		proxy.countThrottledRequest(rt.Name, "rejected")
+		w.Header().Set("Retry-After", retryAfterSeconds(wait))
+		http.Error(w, fmt.Sprintf("uds-proxy: rate limit of route %q exceeded", rt.Name), http.StatusTooManyRequests)
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	proxy.countThrottledRequest(rt.Name, "delayed")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		bucket.cancel(rt.rateLimit)
+		return false
+	}
+}
+
+// honourRetryAfter pauses bucket if the upstream answered 429 or 503 with a Retry-After header, but
+// for rate-limit-max-pause at most.
+func honourRetryAfter(bucket *tokenBucket, rt *route, response *http.Response) {
+	if bucket == nil || rt.rateLimit.maxPause <= 0 ||
+		response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	value := response.Header.Get("Retry-After")
+	until, err := http.ParseTime(value)
+	if seconds, atoiErr := strconv.Atoi(value); atoiErr == nil && seconds >= 0 {
+		until, err = time.Now().Add(time.Duration(seconds)*time.Second), nil
+	}
+	if err != nil {
+		return
+	}
+	if limit := time.Now().Add(rt.rateLimit.maxPause); until.After(limit) {
+		log.Printf("rate limit of route %q: upstream asked for a pause until %s, limited to rate-limit-max-pause of %s",
+			rt.Name, until.Format(time.RFC3339), rt.rateLimit.maxPause)
+		until = limit
+	}
+	if bucket.pause(rt.rateLimit, until) {
+		log.Printf("rate limit of route %q: paused until %s as asked by upstream", rt.Name, until.Format(time.RFC3339))
+	}
+}
+
+// retryAfterSeconds formats d as value of a Retry-After header, rounding up to whole seconds.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
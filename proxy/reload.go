@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// runtimeConfig holds everything handleProxyRequest needs that Reload() may swap at runtime.
+// Requests load it once, so they complete using the clients they started with.
+type runtimeConfig struct {
+	options      Settings
+	listeners    map[string]*listenerConfig
+	pool         *transportPool
+	connectPorts map[string]bool
+	httpClient   *http.Client // for the default route, see CurrentHTTPClient()
+}
+
+// restartOnlyOptions cannot be changed by Reload(); changes are logged and ignored.
+var restartOnlyOptions = []string{"socket", "socket-mode", "socket-group", "socket-create-dir", "socket-h2c", "listen-tcp", "pid-file",
+	"prometheus-port", "metrics-peer-uid", "socket-read-timeout", "socket-write-timeout", "no-access-log",
+	"no-log-timestamps"}
+
+// newRuntimeConfig builds HTTP clients and routes for args, reading args.RoutesFile if set.
+func (proxy *Instance) newRuntimeConfig(args Settings) (*runtimeConfig, error) {
+	if args.RoutesFile != "" {
+		routes, err := loadRoutesFile(args.RoutesFile)
+		if err != nil {
+			return nil, fmt.Errorf("routes-file: %s", err)
+		}
+		args.Routes = append(args.Routes[:len(args.Routes):len(args.Routes)], routes...)
+	}
+	if err := args.Validate(); err != nil {
+		return nil, err
+	}
+	var resolver *dnsResolver
+	if args.DNSCache {
+		servers, _ := parseDNSServers(args.DNSServers)
+		resolver = &dnsResolver{cache: proxy.dnsCache, servers: servers,
+			staleTTL: time.Duration(args.DNSStaleTTL) * time.Millisecond}
+	}
+	overrides, _ := parseHostOverrides(args.HostOverrides)
+	cfg := &runtimeConfig{options: args, listeners: make(map[string]*listenerConfig),
+		pool: newTransportPool(resolver, overrides, args.LogHostOverrides)}
+	cfg.connectPorts, _ = parsePortList(args.ConnectPorts)
+	for i, l := range args.listenerDefinitions() {
+		lc, err := proxy.newListenerConfig(args, l, cfg.pool)
+		if err != nil {
+			if i > 0 {
+				err = fmt.Errorf("listeners[%d]: %s", i-1, err)
+			}
+			return nil, err
+		}
+		cfg.listeners[l.Name] = lc
+	}
+	if resolver != nil {
+		// http.Transport dials without the request's deadline, the longest client-timeout bounds them
+		resolver.dialTimeout = cfg.maxClientTimeout()
+	}
+	defaultRoute := cfg.listeners[defaultListener].defaultRoute
+	cfg.httpClient = &http.Client{Transport: defaultRoute.client.Transport, Timeout: defaultRoute.timeout}
+	return cfg, nil
+}
+
+func (proxy *Instance) runtime() *runtimeConfig {
+	return proxy.config.Load().(*runtimeConfig)
+}
+
+// CurrentOptions returns the Settings currently in use, which Reload() may have changed since startup.
+func (proxy *Instance) CurrentOptions() Settings {
+	return proxy.runtime().options
+}
+
+// CurrentHTTPClient returns a client for the default route currently in use, like HTTPClient at startup.
+func (proxy *Instance) CurrentHTTPClient() *http.Client {
+	return proxy.runtime().httpClient
+}
+
+func isRestartOnlyOption(name string) bool {
+	for _, option := range restartOnlyOptions {
+		if option == name {
+			return true
+		}
+	}
+	return false
+}
+
+// closeIdleConnections closes idle connections of all clients in cfg.
+func (cfg *runtimeConfig) closeIdleConnections() {
+	for _, transport := range cfg.pool.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+// maxClientTimeout returns the longest any request using cfg may take.
+func (cfg *runtimeConfig) maxClientTimeout() (max time.Duration) {
+	for _, lc := range cfg.listeners {
+		for _, rt := range append(lc.routes, lc.defaultRoute) {
+			if rt.timeout > max {
+				max = rt.timeout
+			}
+		}
+	}
+	return
+}
+
+// Reload re-reads the configuration using ConfigLoader (or, if nil, the Settings initially passed
+// to NewProxyInstance plus a fresh copy of RoutesFile) and atomically swaps HTTP clients and routes.
+// Requests in flight complete on the previous clients. It is invoked on SIGHUP.
+func (proxy *Instance) Reload() error {
+	proxy.reloadMutex.Lock()
+	defer proxy.reloadMutex.Unlock()
+
+	cfg, err := proxy.loadRuntimeConfig()
+	if err != nil {
+		log.Printf("configuration reload failed, keeping current configuration: %s", err)
+		proxy.countReload("failure")
+		return err
+	}
+	previous := proxy.runtime()
+	proxy.config.Store(cfg)
+
+	// connections used by requests in flight return to the old pools later; close them, too
+	previous.closeIdleConnections()
+	time.AfterFunc(previous.maxClientTimeout()+time.Second, previous.closeIdleConnections)
+
+	log.Printf("configuration reloaded: %d route(s)", len(cfg.options.Routes))
+	proxy.countReload("success")
+	return nil
+}
+
+func (proxy *Instance) loadRuntimeConfig() (*runtimeConfig, error) {
+	args := proxy.initialSettings
+	if proxy.ConfigLoader != nil {
+		var err error
+		if args, err = proxy.ConfigLoader(); err != nil {
+			return nil, err
+		}
+	}
+	current := proxy.runtime().options
+	for _, name := range restartOnlyOptions {
+		newField, _ := args.optionField(name)
+		currentField, _ := current.optionField(name)
+		if newField.Interface() != currentField.Interface() {
+			log.Printf("configuration reload: ignoring change of %s, which requires a restart", name)
+			newField.Set(currentField)
+		}
+	}
+	if !reflect.DeepEqual(socketsOf(args.Listeners), socketsOf(current.Listeners)) {
+		log.Print("configuration reload: ignoring change of listeners, adding, removing or changing sockets requires a restart")
+		args.Listeners = current.Listeners
+	}
+	return proxy.newRuntimeConfig(args)
+}
+
+// socketsOf returns the parts of listeners bound to their sockets, which cannot be reloaded.
+func socketsOf(listeners []Listener) (sockets []Listener) {
+	for _, l := range listeners {
+		sockets = append(sockets, Listener{Name: l.Name, Socket: l.Socket, SocketMode: l.SocketMode, SocketGroup: l.SocketGroup})
+	}
+	return
+}
+
+func (proxy *Instance) countReload(result string) {
+	if proxy.metrics.enabled {
+		proxy.metrics.ConfigReloads.WithLabelValues(result).Inc()
+	}
+}
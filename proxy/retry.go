@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+// idempotentMethods may be repeated without changing the result, see RFC 7231, section 4.2.2.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// isIdempotent reports whether request may be repeated; like http.Transport, requests carrying an
+// idempotency key are considered idempotent, too.
+func isIdempotent(request *http.Request) bool {
+	return idempotentMethods[request.Method] || request.Header.Get("Idempotency-Key") != "" ||
+		request.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retryingTransport repeats requests that failed without a response, up to retries times. Idempotent
+// requests are repeated if their body is empty or could be buffered (up to bufferSize bytes), others
+// only if nothing has been sent yet. Retries wait for an exponential, jittered backoff and stop once
+// timeout, i.e. client-timeout, would pass.
+type retryingTransport struct {
+	transport  http.RoundTripper
+	retries    int
+	backoff    time.Duration
+	bufferSize int
+	timeout    time.Duration
+	retried    func() // counts a retry, if metrics are enabled
+}
+
+func (t *retryingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	body, unbuffered, err := t.attemptBody(request)
+	if err != nil {
+		return nil, err
+	}
+	replayable := isIdempotent(request) && unbuffered == nil
+	ctx := request.Context()
+	deadline := time.Now().Add(t.timeout)
+	for attempt := 0; ; attempt++ {
+		var sent int32
+		trace := &httptrace.ClientTrace{WroteHeaders: func() { atomic.StoreInt32(&sent, 1) }}
+		attemptRequest := request.Clone(httptrace.WithClientTrace(ctx, trace))
+		if body != nil {
+			attemptRequest.Body = body()
+		}
+		response, err := t.transport.RoundTrip(attemptRequest)
+		if err == nil || attempt == t.retries || ctx.Err() != nil || !isRetryableError(err) {
+			return response, err
+		}
+		if !replayable && (atomic.LoadInt32(&sent) != 0 || unbuffered != nil && unbuffered.wasRead()) {
+			return nil, err
+		}
+
+		delay := t.delay(attempt)
+		if t.timeout > 0 && time.Now().Add(delay).After(deadline) {
+			return nil, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		if t.retried != nil {
+			t.retried()
+		}
+	}
+}
+
+// attemptBody returns a function providing the body for each attempt, nil if request has no body.
+// Bodies of idempotent requests are buffered if their size is known and within bufferSize. Others are
+// returned as unbuffered and passed on as is, protected from being closed by failed attempts.
+func (t *retryingTransport) attemptBody(request *http.Request) (func() io.ReadCloser, *trackingBody, error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, nil, nil
+	}
+	if isIdempotent(request) && request.ContentLength > 0 && request.ContentLength <= int64(t.bufferSize) {
+		buffer := make([]byte, request.ContentLength)
+		if _, err := io.ReadFull(request.Body, buffer); err != nil {
+			return nil, nil, err
+		}
+		return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(buffer)) }, nil, nil
+	}
+	unbuffered := &trackingBody{Reader: request.Body}
+	return func() io.ReadCloser { return unbuffered }, unbuffered, nil
+}
+
+// delay returns the backoff before retry attempt+1: retry-backoff doubled per attempt, of which up to
+// half is randomized so that clients failing at the same time do not retry in lockstep.
+func (t *retryingTransport) delay(attempt int) time.Duration {
+	delay := t.backoff
+	for i := 0; i < attempt && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetryableError reports whether an attempt failing with err may succeed when repeated.
+func isRetryableError(err error) bool {
+	var certificateError *tls.CertificateVerificationError
+	return !errors.As(err, &certificateError)
+}
+
+// trackingBody records whether the body has been read from; Close is left to the server.
+type trackingBody struct {
+	io.Reader
+	read int32
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&b.read, 1)
+	return b.Reader.Read(p)
+}
+
+func (b *trackingBody) Close() error {
+	return nil
+}
+
+func (b *trackingBody) wasRead() bool {
+	return atomic.LoadInt32(&b.read) != 0
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route maps requests, selected by their Host header, to an upstream. Zero values
+// fall back to the request's host/port and the global Settings, respectively.
+//
+// The upstream Host header is the client's unless HostOverride is set; for https, the certificate
+// is verified against SNI, if set, else against the upstream address. TLSCert and TLSKey, if set,
+// provide a client certificate, TLSCA a bundle of CAs to trust instead of the system's.
+// UpstreamProtocol selects HTTP/1.1 or HTTP/2, see Settings.
+//
+// Host patterns may be exact ("api.example.com"), wildcards ("*.example.com"; "*" matches any host)
+// or regular expressions prefixed with "~" ("~^api[0-9]+\.example\.com$"). Routes are matched in order.
+//
+// If AllowUIDs or AllowGIDs are set, only processes running with one of these user ids or
+// primary group ids (as reported by SO_PEERCRED) may use the route; others get 403 Forbidden.
+type Route struct {
+	Name                   string `json:"name,omitempty"`
+	Host                   string `json:"host,omitempty"`
+	Scheme                 string `json:"scheme,omitempty"`
+	Address                string `json:"address,omitempty"`
+	Port                   int    `json:"port,omitempty"`
+	HostOverride           string `json:"host-override,omitempty"`
+	SNI                    string `json:"sni,omitempty"`
+	ClientTimeout          int    `json:"client-timeout,omitempty"`
+	MaxConnsPerHost        int    `json:"max-conns-per-host,omitempty"`
+	MaxIdleConnsPerHost    int    `json:"max-idle-conns-per-host,omitempty"`
+	IdleConnTimeout        int    `json:"idle-timeout,omitempty"`
+	TLSCert                string `json:"tls-cert,omitempty"`
+	TLSKey                 string `json:"tls-key,omitempty"`
+	TLSCA                  string `json:"tls-ca,omitempty"`
+	TLSMinVersion          string `json:"tls-min-version,omitempty"`
+	TLSCipherSuites        string `json:"tls-cipher-suites,omitempty"`
+	UpstreamProtocol       string `json:"upstream-protocol,omitempty"`
+	H2MaxConcurrentStreams int    `json:"h2-max-concurrent-streams,omitempty"`
+	H2PingInterval         int    `json:"h2-ping-interval,omitempty"`
+	H2PingTimeout          int    `json:"h2-ping-timeout,omitempty"`
+	Retries                int    `json:"retries,omitempty"`
+	RetryBackoff           int    `json:"retry-backoff,omitempty"`
+	RetryBufferSize        int    `json:"retry-buffer-size,omitempty"`
+	BreakerFailures        int    `json:"breaker-failures,omitempty"`
+	BreakerErrorRate       int    `json:"breaker-error-rate,omitempty"`
+	BreakerTimeoutRate     int    `json:"breaker-timeout-rate,omitempty"`
+	BreakerMinRequests     int    `json:"breaker-min-requests,omitempty"`
+	BreakerWindow          int    `json:"breaker-window,omitempty"`
+	BreakerOpenTime        int    `json:"breaker-open-time,omitempty"`
+	HedgePercentile        int    `json:"hedge-percentile,omitempty"`
+	HedgeBudget            int    `json:"hedge-budget,omitempty"`
+	HedgeMinDelay          int    `json:"hedge-min-delay,omitempty"`
+	RateLimit              string `json:"rate-limit,omitempty"`
+	RateLimitBurst         int    `json:"rate-limit-burst,omitempty"`
+	RateLimitKey           string `json:"rate-limit-key,omitempty"`
+	RateLimitMode          string `json:"rate-limit-mode,omitempty"`
+	RateLimitQueueTimeout  int    `json:"rate-limit-queue-timeout,omitempty"`
+	RateLimitMaxPause      int    `json:"rate-limit-max-pause,omitempty"`
+	MaxConcurrency         int    `json:"max-concurrency,omitempty"`
+	ConcurrencyQueue       int    `json:"concurrency-queue,omitempty"`
+	ConcurrencyTimeout     int    `json:"concurrency-timeout,omitempty"`
+	ConcurrencyMode        string `json:"concurrency-mode,omitempty"`
+	AllowUIDs              []int  `json:"allow-uids,omitempty"`
+	AllowGIDs              []int  `json:"allow-gids,omitempty"`
+}
+
+// route is a compiled Route with its own HTTP client (i.e. connection pool).
+type route struct {
+	Route
+	matches     func(host string) bool
+	client      *http.Client
+	tlsConfig   *tls.Config
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	timeout     time.Duration
+	breaker     breakerPolicy
+	rateLimit   rateLimitPolicy
+	concurrency concurrencyPolicy
+	scheme      string
+}
+
+type routeTable []*route
+
+// match returns the first route matching host (which may include a port), or nil.
+func (table routeTable) match(host string) *route {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, rt := range table {
+		if rt.matches(host) {
+			return rt
+		}
+	}
+	return nil
+}
+
+func hostMatcher(pattern string) (func(host string) bool, error) {
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("host pattern must not be empty")
+	case pattern == "*":
+		return func(string) bool { return true }, nil
+	case strings.HasPrefix(pattern, "~"):
+		re, err := regexp.Compile(pattern[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid host regex %q: %s", pattern[1:], err)
+		}
+		return re.MatchString, nil
+	case strings.HasPrefix(pattern, "*."):
+		suffix := strings.ToLower(pattern[1:])
+		return func(host string) bool { return strings.HasSuffix(host, suffix) }, nil
+	case strings.Contains(pattern, "*"):
+		return nil, fmt.Errorf("invalid host pattern %q: wildcards are only supported as leading '*.'", pattern)
+	default:
+		exact := strings.ToLower(pattern)
+		return func(host string) bool { return host == exact }, nil
+	}
+}
+
+// validate reports the first invalid field of r.
+func (r Route) validate() error {
+	if _, err := hostMatcher(r.Host); err != nil {
+		return fmt.Errorf("host: %s", err)
+	}
+	if r.Scheme != "" && r.Scheme != "http" && r.Scheme != "https" {
+		return fmt.Errorf("scheme: must be http or https, got %q", r.Scheme)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("port: must be within 0-65535, got %d", r.Port)
+	}
+	nonNegative := []struct {
+		name  string
+		value int
+	}{
+		{"client-timeout", r.ClientTimeout},
+		{"max-conns-per-host", r.MaxConnsPerHost},
+		{"max-idle-conns-per-host", r.MaxIdleConnsPerHost},
+		{"idle-timeout", r.IdleConnTimeout},
+		{"h2-max-concurrent-streams", r.H2MaxConcurrentStreams},
+		{"h2-ping-interval", r.H2PingInterval},
+		{"h2-ping-timeout", r.H2PingTimeout},
+		{"retries", r.Retries},
+		{"retry-backoff", r.RetryBackoff},
+		{"retry-buffer-size", r.RetryBufferSize},
+		{"breaker-failures", r.BreakerFailures},
+		{"breaker-min-requests", r.BreakerMinRequests},
+		{"breaker-window", r.BreakerWindow},
+		{"breaker-open-time", r.BreakerOpenTime},
+		{"hedge-min-delay", r.HedgeMinDelay},
+		{"rate-limit-burst", r.RateLimitBurst},
+		{"rate-limit-queue-timeout", r.RateLimitQueueTimeout},
+		{"rate-limit-max-pause", r.RateLimitMaxPause},
+		{"max-concurrency", r.MaxConcurrency},
+		{"concurrency-queue", r.ConcurrencyQueue},
+		{"concurrency-timeout", r.ConcurrencyTimeout},
+	}
+	for _, option := range nonNegative {
+		if option.value < 0 {
+			return fmt.Errorf("%s: must not be negative, got %d", option.name, option.value)
+		}
+	}
+	if err := validateUpstreamProtocol(r.UpstreamProtocol); err != nil {
+		return fmt.Errorf("upstream-protocol: %s", err)
+	}
+	if err := validateUpstreamTLS(r.TLSCert, r.TLSKey, r.TLSMinVersion, r.TLSCipherSuites); err != nil {
+		return err
+	}
+	if err := validateBreakerRates(r.BreakerErrorRate, r.BreakerTimeoutRate); err != nil {
+		return err
+	}
+	if err := validateHedging(r.HedgePercentile, r.HedgeBudget); err != nil {
+		return err
+	}
+	if err := validateRateLimit(r.RateLimit, r.RateLimitMode, r.RateLimitKey); err != nil {
+		return err
+	}
+	if err := validateConcurrencyMode(r.ConcurrencyMode); err != nil {
+		return err
+	}
+	for _, uid := range r.AllowUIDs {
+		if uid < 0 {
+			return fmt.Errorf("allow-uids: must not be negative, got %d", uid)
+		}
+	}
+	for _, gid := range r.AllowGIDs {
+		if gid < 0 {
+			return fmt.Errorf("allow-gids: must not be negative, got %d", gid)
+		}
+	}
+	return nil
+}
+
+// allows reports whether peer may use the route.
+func (r Route) allows(peer *peerCred) bool {
+	return allowedPeer(r.AllowUIDs, r.AllowGIDs, peer)
+}
+
+// allowedPeer reports whether peer runs with one of uids or gids; empty lists allow anyone.
+func allowedPeer(uids, gids []int, peer *peerCred) bool {
+	if len(uids) == 0 && len(gids) == 0 {
+		return true
+	}
+	if peer == nil {
+		return false
+	}
+	for _, uid := range uids {
+		if uid == peer.uid {
+			return true
+		}
+	}
+	for _, gid := range gids {
+		if gid == peer.gid {
+			return true
+		}
+	}
+	return false
+}
+
+// newRoute compiles r, creating an HTTP client configured by r and the global settings opt.
+// Routes with identical connection settings share pool's transports.
+func (proxy *Instance) newRoute(opt Settings, r Route, pool *transportPool) (*route, error) {
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	matches, _ := hostMatcher(r.Host)
+	if r.Name == "" {
+		r.Name = r.Host
+	}
+	rt := &route{Route: r, matches: matches, scheme: r.Scheme}
+	if rt.scheme == "" {
+		rt.scheme = "http"
+		if opt.RemoteHTTPS {
+			rt.scheme = "https"
+		}
+	}
+
+	if r.ClientTimeout != 0 {
+		opt.ClientTimeout = r.ClientTimeout
+	}
+	if r.MaxConnsPerHost != 0 {
+		opt.MaxConnsPerHost = r.MaxConnsPerHost
+	}
+	if r.MaxIdleConnsPerHost != 0 {
+		opt.MaxIdleConnsPerHost = r.MaxIdleConnsPerHost
+	}
+	if r.IdleConnTimeout != 0 {
+		opt.IdleConnTimeout = r.IdleConnTimeout
+	}
+	if r.TLSCert != "" {
+		opt.TLSCert, opt.TLSKey = r.TLSCert, r.TLSKey
+	}
+	if r.TLSCA != "" {
+		opt.TLSCA = r.TLSCA
+	}
+	if r.TLSMinVersion != "" {
+		opt.TLSMinVersion = r.TLSMinVersion
+	}
+	if r.TLSCipherSuites != "" {
+		opt.TLSCipherSuites = r.TLSCipherSuites
+	}
+	if r.UpstreamProtocol != "" {
+		opt.UpstreamProtocol = r.UpstreamProtocol
+	}
+	if r.H2MaxConcurrentStreams != 0 {
+		opt.H2MaxConcurrentStreams = r.H2MaxConcurrentStreams
+	}
+	if r.H2PingInterval != 0 {
+		opt.H2PingInterval = r.H2PingInterval
+	}
+	if r.H2PingTimeout != 0 {
+		opt.H2PingTimeout = r.H2PingTimeout
+	}
+	if r.Retries != 0 {
+		opt.Retries = r.Retries
+	}
+	if r.RetryBackoff != 0 {
+		opt.RetryBackoff = r.RetryBackoff
+	}
+	if r.RetryBufferSize != 0 {
+		opt.RetryBufferSize = r.RetryBufferSize
+	}
+	if r.BreakerFailures != 0 {
+		opt.BreakerFailures = r.BreakerFailures
+	}
+	if r.BreakerErrorRate != 0 {
+		opt.BreakerErrorRate = r.BreakerErrorRate
+	}
+	if r.BreakerTimeoutRate != 0 {
+		opt.BreakerTimeoutRate = r.BreakerTimeoutRate
+	}
+	if r.BreakerMinRequests != 0 {
+		opt.BreakerMinRequests = r.BreakerMinRequests
+	}
+	if r.BreakerWindow != 0 {
+		opt.BreakerWindow = r.BreakerWindow
+	}
+	if r.BreakerOpenTime != 0 {
+		opt.BreakerOpenTime = r.BreakerOpenTime
+	}
+	if r.HedgePercentile != 0 {
+		opt.HedgePercentile = r.HedgePercentile
+	}
+	if r.HedgeBudget != 0 {
+		opt.HedgeBudget = r.HedgeBudget
+	}
+	if r.HedgeMinDelay != 0 {
+		opt.HedgeMinDelay = r.HedgeMinDelay
+	}
+	if r.RateLimit != "" {
+		opt.RateLimit = r.RateLimit
+	}
+	if r.RateLimitBurst != 0 {
+		opt.RateLimitBurst = r.RateLimitBurst
+	}
+	if r.RateLimitKey != "" {
+		opt.RateLimitKey = r.RateLimitKey
+	}
+	if r.RateLimitMode != "" {
+		opt.RateLimitMode = r.RateLimitMode
+	}
+	if r.RateLimitQueueTimeout != 0 {
+		opt.RateLimitQueueTimeout = r.RateLimitQueueTimeout
+	}
+	if r.RateLimitMaxPause != 0 {
+		opt.RateLimitMaxPause = r.RateLimitMaxPause
+	}
+	if r.MaxConcurrency != 0 {
+		opt.MaxConcurrency = r.MaxConcurrency
+	}
+	if r.ConcurrencyQueue != 0 {
+		opt.ConcurrencyQueue = r.ConcurrencyQueue
+	}
+	if r.ConcurrencyTimeout != 0 {
+		opt.ConcurrencyTimeout = r.ConcurrencyTimeout
+	}
+	if r.ConcurrencyMode != "" {
+		opt.ConcurrencyMode = r.ConcurrencyMode
+	}
+	transport, err := pool.get(&opt, r.SNI)
+	if err != nil {
+		return nil, err
+	}
+	rt.tlsConfig = transport.TLSClientConfig
+	rt.dialContext = pool.dialContext
+	rt.timeout = time.Duration(opt.ClientTimeout) * time.Millisecond
+	rt.breaker = newBreakerPolicy(&opt)
+	rt.rateLimit = newRateLimitPolicy(&opt)
+	rt.concurrency = newConcurrencyPolicy(&opt)
+	rt.client = proxy.newHTTPClient(&opt, transport, r.Name)
+	return rt, nil
+}
+
+// upstreamHost returns the host:port (or host) to connect to for a request to requestHost.
+func (rt *route) upstreamHost(requestHost string) string {
+	host, port, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		host, port = requestHost, ""
+	}
+	if rt.Address != "" {
+		host = rt.Address
+	}
+	if rt.Port != 0 {
+		port = strconv.Itoa(rt.Port)
+	}
+	if port == "" {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// targetURL returns the upstream URL for clientRequest. Requests in absolute-form, as sent to an
+// explicit proxy, may ask for https unless the route configures a scheme.
+func (rt *route) targetURL(clientRequest *http.Request) string {
+	scheme := rt.scheme
+	if rt.Scheme == "" && clientRequest.URL.Scheme == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, rt.upstreamHost(clientRequest.Host), clientRequest.URL.RequestURI())
+}
+
+// setBackendHost sets the Host header sent upstream: the route's override, if any, else the client's.
+func (rt *route) setBackendHost(backendRequest, clientRequest *http.Request) {
+	backendRequest.Host = clientRequest.Host
+	if rt.HostOverride != "" {
+		backendRequest.Host = rt.HostOverride
+	}
+}
+
+// loadRoutesFile reads routes from a JSON, YAML or TOML file of the form {"routes": [{"host": ...}, ...]}.
+func loadRoutesFile(path string) ([]Route, error) {
+	var file struct {
+		Routes []Route `json:"routes,omitempty"`
+	}
+	err := decodeConfigFile(path, &file)
+	return file.Routes, err
+}
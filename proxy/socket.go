@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// listen creates the socket of definition. It is set up under a temporary name and renamed into
+// place once socket mode and group are applied, so clients never see it with other permissions.
+// An existing (stale) socket is replaced. Abstract sockets are created as is.
+func (proxy *Instance) listen(definition Listener) (*net.UnixListener, error) {
+	path := definition.Socket
+	if isAbstractSocket(path) {
+		return net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	}
+	mode, err := parseSocketMode(definition.SocketMode)
+	if err != nil {
+		return nil, fmt.Errorf("socket-mode: %s", err)
+	}
+	gid, err := lookupGroup(definition.SocketGroup)
+	if err != nil {
+		return nil, fmt.Errorf("socket-group: %s", err)
+	}
+	dir := filepath.Dir(path)
+	if proxy.Options.SocketCreateDir {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("socket-create-dir: %s", err)
+		}
+	}
+
+	tmpPath := filepath.Join(dir, fmt.Sprintf(".uds-proxy-%d.sock", os.Getpid()))
+	os.Remove(tmpPath)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false) // renamed below, Shutdown() removes it
+	if mode != 0 {
+		if err = os.Chmod(tmpPath, mode); err != nil {
+			err = fmt.Errorf("socket-mode: %s", err)
+		}
+	}
+	if err == nil && gid != -1 {
+		if err = os.Chown(tmpPath, -1, gid); err != nil {
+			err = fmt.Errorf("socket-group: %s", err)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return listener, nil
+}
+
+// parseSocketMode parses an octal permission mode such as "0660"; empty yields 0 (keep umask default).
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m == 0 || m > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions like 0660", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupGroup resolves a group name or numeric id; empty yields -1 (keep the process' group).
+func lookupGroup(group string) (int, error) {
+	if group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(group); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// isAbstractSocket reports whether path names a socket in Linux' abstract namespace ("@name").
+// Such sockets have no file, hence no permissions, and vanish once closed.
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// validateLoopbackAddress checks that address is of form host:port, host being localhost or a
+// loopback IP: a TCP listener must not expose the proxy beyond this machine.
+func validateLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%q is not of form host:port", address)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", host)
+	}
+	return nil
+}
+
+// validateSocketPath checks that path can be used on this platform.
+func validateSocketPath(path string) error {
+	if isAbstractSocket(path) && runtime.GOOS != "linux" {
+		return fmt.Errorf("abstract sockets (@name) are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamResponseBody copies the backend response body to the client, flushing as needed.
+// Event streams and bodies of unknown length are flushed after every write, others
+// every flushInterval milliseconds. A negative interval flushes after every write.
+func streamResponseBody(w http.ResponseWriter, backendResponse *http.Response, flushInterval int) error {
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		interval := responseFlushInterval(backendResponse, flushInterval)
+		if interval != 0 {
+			mlw := &maxLatencyWriter{dst: w, flusher: flusher, latency: interval}
+			defer mlw.stop()
+			dst = mlw
+		}
+	}
+	_, err := io.Copy(dst, backendResponse.Body)
+	return err
+}
+
+func responseFlushInterval(backendResponse *http.Response, flushInterval int) time.Duration {
+	if isStreamingResponse(backendResponse) {
+		return -1
+	}
+	return time.Duration(flushInterval) * time.Millisecond
+}
+
+// isStreamingResponse reports whether the response is an event stream or has a body of unknown length,
+// e.g. a long poll, which may be passed on for longer than client-timeout and socket-write-timeout.
+func isStreamingResponse(backendResponse *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(backendResponse.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream" || backendResponse.ContentLength == -1
+}
+
+// isStreamingRequest reports whether the request body is a gRPC stream or of unknown length, which
+// may be read for longer than socket-read-timeout.
+func isStreamingRequest(clientRequest *http.Request) bool {
+	if clientRequest.Body == nil || clientRequest.Body == http.NoBody {
+		return false
+	}
+	return isGRPC(clientRequest.Header) || clientRequest.ContentLength == -1
+}
+
+// upstreamDeadline cancels an upstream request after client-timeout, like http.Client.Timeout, but
+// may be lifted once the response headers arrived so that streaming responses are not cut.
+type upstreamDeadline struct {
+	timer    *time.Timer
+	exceeded int32
+}
+
+// withUpstreamDeadline returns a copy of ctx that is cancelled after timeout (0 meaning never) unless
+// the deadline is lifted, and a function releasing its resources.
+func withUpstreamDeadline(ctx context.Context, timeout time.Duration) (context.Context, *upstreamDeadline, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	deadline := &upstreamDeadline{}
+	if timeout > 0 {
+		deadline.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&deadline.exceeded, 1)
+			cancel()
+		})
+	}
+	return ctx, deadline, func() {
+		deadline.lift()
+		cancel()
+	}
+}
+
+func (d *upstreamDeadline) lift() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func (d *upstreamDeadline) wasExceeded() bool {
+	return atomic.LoadInt32(&d.exceeded) != 0
+}
+
+type responseControllerKey struct{}
+
+// withResponseController makes the http.ResponseController of the server's response writer available
+// to handlers wrapped by metrics instrumentation, see liftWriteDeadline().
+func withResponseController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// liftWriteDeadline removes socket-write-timeout for the response to r, which is streamed.
+func liftWriteDeadline(w http.ResponseWriter, r *http.Request) error {
+	return responseController(w, r).SetWriteDeadline(time.Time{})
+}
+
+// liftReadDeadline removes socket-read-timeout for the body of r, which is streamed.
+func liftReadDeadline(w http.ResponseWriter, r *http.Request) error {
+	return responseController(w, r).SetReadDeadline(time.Time{})
+}
+
+func responseController(w http.ResponseWriter, r *http.Request) *http.ResponseController {
+	if controller, ok := r.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		return controller
+	}
+	return http.NewResponseController(w)
+}
+
+// maxLatencyWriter flushes written data either immediately (latency < 0)
+// or at most latency after it has been written.
+type maxLatencyWriter struct {
+	dst     io.Writer
+	flusher http.Flusher
+	latency time.Duration
+
+	mu           sync.Mutex // protects t, flushPending and writes to dst
+	t            *time.Timer
+	flushPending bool
+}
+
+func (m *maxLatencyWriter) Write(p []byte) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err = m.dst.Write(p)
+	if m.latency < 0 {
+		m.flusher.Flush()
+		return
+	}
+	if m.flushPending {
+		return
+	}
+	if m.t == nil {
+		m.t = time.AfterFunc(m.latency, m.delayedFlush)
+	} else {
+		m.t.Reset(m.latency)
+	}
+	m.flushPending = true
+	return
+}
+
+func (m *maxLatencyWriter) delayedFlush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.flushPending { // if stop was called but AfterFunc already started this goroutine
+		return
+	}
+	m.flusher.Flush()
+	m.flushPending = false
+}
+
+func (m *maxLatencyWriter) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushPending = false
+	if m.t != nil {
+		m.t.Stop()
+	}
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const systemdListenFDsStart = 3
+
+// systemdListeners returns the listening sockets passed by systemd socket activation (LISTEN_PID,
+// LISTEN_FDS and LISTEN_FDNAMES, see sd_listen_fds(3)), if any, by the socket path of the listener
+// they belong to: the one named like the socket (FileDescriptorName=) or else bound to its path.
+func systemdListeners(definitions []Listener) (map[string]*socketListener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// must not leak into processes started by Upgrade()
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("LISTEN_FDS: invalid number of file descriptors %q", fds)
+	}
+
+	listeners := make(map[string]*socketListener)
+	for i := 0; i < count; i++ {
+		fd := systemdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+		l, err := fileListener(os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FDS[%d]", i)))
+		if err != nil {
+			return listeners, fmt.Errorf("socket %s passed by systemd: %s", fdName(names, i), err)
+		}
+		path := l.Addr().String()
+		for _, definition := range definitions {
+			if i < len(names) && names[i] == definition.Name {
+				path = definition.Socket
+			}
+		}
+		_, tcp := l.(*net.TCPListener)
+		listeners[path] = &socketListener{Listener: l, path: path, systemd: true, tcp: tcp}
+	}
+	return listeners, nil
+}
+
+func fdName(names []string, i int) string {
+	if i < len(names) && names[i] != "" {
+		return strconv.Quote(names[i])
+	}
+	return strconv.Itoa(systemdListenFDsStart + i)
+}
+
+// sdNotify sends state (e.g. "READY=1") to the service manager if NOTIFY_SOCKET is set,
+// see sd_notify(3). Without NOTIFY_SOCKET, it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %s", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("sd_notify: %s", err)
+	}
+	return nil
+}
+
+// watchdogInterval returns how often to send WATCHDOG=1 (half the WATCHDOG_USEC timeout configured
+// by WatchdogSec=), or 0 if the service manager does not expect keep-alive pings from this process.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady reports readiness to systemd and starts sending watchdog pings until Shutdown().
+// A process started by Upgrade() also announces itself as the service's new main process.
+func (proxy *Instance) notifyReady() {
+	state := "READY=1"
+	if proxy.inherited {
+		state = fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), state)
+	}
+	if err := sdNotify(state); err != nil {
+		log.Print(err)
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Print(err)
+				}
+			case <-proxy.shutdownDone:
+				return
+			}
+		}
+	}()
+}
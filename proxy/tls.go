@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often client certificate files are checked for changes.
+const certCheckInterval = time.Second
+
+// upstreamTLS holds the TLS settings for connections to an upstream: client certificate and key,
+// CA bundle, minimum version, cipher suites and server name (SNI). See Settings and Route.
+type upstreamTLS struct {
+	cert, key, ca, minVersion, cipherSuites, serverName string
+}
+
+// tlsVersions maps the values accepted by tls-min-version to crypto/tls versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses a version such as "1.2"; empty yields 0 (crypto/tls default).
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid version %q, expected 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names as defined by crypto/tls,
+// e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"; empty yields nil (crypto/tls default).
+func parseCipherSuites(names string) (ids []uint16, err error) {
+	if names == "" {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(names, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", strings.TrimSpace(name))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// validateUpstreamTLS checks the TLS options that can be validated without reading files.
+func validateUpstreamTLS(cert, key, minVersion, cipherSuites string) error {
+	if cert != "" && key == "" {
+		return fmt.Errorf("tls-key: must be set along with tls-cert")
+	}
+	if key != "" && cert == "" {
+		return fmt.Errorf("tls-cert: must be set along with tls-key")
+	}
+	if _, err := parseTLSVersion(minVersion); err != nil {
+		return fmt.Errorf("tls-min-version: %s", err)
+	}
+	if _, err := parseCipherSuites(cipherSuites); err != nil {
+		return fmt.Errorf("tls-cipher-suites: %s", err)
+	}
+	return nil
+}
+
+// tlsConfig returns the client TLS configuration for t, or nil if t leaves everything at defaults.
+// Client certificates are loaded once per pool and reloaded when their files change.
+func (pool *transportPool) tlsConfig(t upstreamTLS) (*tls.Config, error) {
+	if t == (upstreamTLS{}) {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: t.serverName}
+	config.MinVersion, _ = parseTLSVersion(t.minVersion)
+	config.CipherSuites, _ = parseCipherSuites(t.cipherSuites)
+	if t.ca != "" {
+		bundle, err := ioutil.ReadFile(t.ca)
+		if err != nil {
+			return nil, fmt.Errorf("tls-ca: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("tls-ca: %s contains no PEM encoded certificates", t.ca)
+		}
+	}
+	if t.cert != "" {
+		files := [2]string{t.cert, t.key}
+		certificate, ok := pool.certificates[files]
+		if !ok {
+			certificate = &clientCertificate{certFile: t.cert, keyFile: t.key}
+			if err := certificate.load(); err != nil {
+				return nil, fmt.Errorf("tls-cert: %s", err)
+			}
+			pool.certificates[files] = certificate
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificate.current(), nil
+		}
+	}
+	return config, nil
+}
+
+// clientCertificate is a certificate and key loaded from files, reloaded when they change on disk.
+type clientCertificate struct {
+	certFile, keyFile string
+	mutex             sync.Mutex
+	certificate       *tls.Certificate
+	stamp             string // identifies the files last loaded, see fileStamp()
+	checked           time.Time
+}
+
+// load reads the certificate and key files.
+func (c *clientCertificate) load() error {
+	stamp, err := fileStamp(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+		return err
+	}
+	c.certificate, c.stamp, c.checked = &certificate, stamp, time.Now()
+	return nil
+}
+
+// current returns the certificate, reloading it first if its files changed since the last check.
+// Should that fail, e.g. as only one of both files has been replaced yet, the previous certificate
+// remains in use until the files change again.
+func (c *clientCertificate) current() *tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.certificate
+	}
+	c.checked = time.Now()
+	stamp, err := fileStamp(c.certFile, c.keyFile)
+	if err != nil || stamp == c.stamp {
+		return c.certificate
+	}
+	if err = c.load(); err != nil {
+		c.stamp = stamp
+		log.Printf("tls-cert: reloading %s failed, keeping certificate valid until %s: %s",
+			c.certFile, c.certificate.Leaf.NotAfter.Format(time.RFC3339), err)
+	} else {
+		log.Printf("tls-cert: reloaded %s, valid until %s", c.certFile, c.certificate.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return c.certificate
+}
+
+// fileStamp identifies the current contents of files by modification time and size.
+func fileStamp(files ...string) (string, error) {
+	var stamp []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		stamp = append(stamp, fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(stamp, ","), nil
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// isUpgradeRequest reports whether the client asks to switch protocols, e.g. to WebSocket.
+func isUpgradeRequest(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && r.Header.Get("Upgrade") != ""
+}
+
+// handleUpgradeRequest forwards an HTTP Upgrade handshake to the backend and, if the backend
+// switches protocols, tunnels bytes between client and backend until either side closes.
+func (proxy *Instance) handleUpgradeRequest(w http.ResponseWriter, clientRequest *http.Request, rt *route, targetURL string) {
+	backendRequest, err := http.NewRequest(clientRequest.Method, targetURL, clientRequest.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	upgradeType := clientRequest.Header.Get("Upgrade")
+	copyHeader(backendRequest.Header, clientRequest.Header)
+	removeHopByHopHeaders(backendRequest.Header)
+	backendRequest.Header.Set("Connection", "Upgrade")
+	backendRequest.Header.Set("Upgrade", upgradeType)
+	backendRequest.Header.Set("X-Request-Via", "uds-proxy")
+	rt.setBackendHost(backendRequest, clientRequest)
+
+	backendConn, err := rt.dial(backendRequest.URL.Scheme, backendRequest.URL.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	backendConn.SetDeadline(time.Now().Add(rt.timeout))
+	if err = backendRequest.Write(backendConn); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	backendResponse, err := http.ReadResponse(backendReader, backendRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	backendConn.SetDeadline(time.Time{})
+	logUpstreamProtocol(clientRequest, backendResponse.Proto)
+
+	if backendResponse.StatusCode != http.StatusSwitchingProtocols {
+		removeHopByHopHeaders(backendResponse.Header)
+		copyHeader(w.Header(), backendResponse.Header)
+		w.Header().Set("X-Response-Via", "uds-proxy")
+		w.WriteHeader(backendResponse.StatusCode)
+		io.Copy(w, backendResponse.Body)
+		backendResponse.Body.Close()
+		return
+	}
+	if !strings.EqualFold(backendResponse.Header.Get("Upgrade"), upgradeType) {
+		http.Error(w, fmt.Sprintf("backend switched to protocol %q, requested %q",
+			backendResponse.Header.Get("Upgrade"), upgradeType), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support protocol upgrades", http.StatusInternalServerError)
+		return
+	}
+	clientConn, clientBuffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("upgrade: hijacking client connection failed: %s", err)
+		return
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Time{})
+
+	backendResponse.Header.Set("X-Response-Via", "uds-proxy")
+	fmt.Fprintf(clientBuffer, "HTTP/1.1 %s\r\n", backendResponse.Status)
+	backendResponse.Header.Write(clientBuffer)
+	clientBuffer.WriteString("\r\n")
+	if err = clientBuffer.Flush(); err != nil {
+		log.Printf("upgrade: writing handshake response failed: %s", err)
+		return
+	}
+
+	proxy.tunnel("upgrade", clientConn, clientBuffer.Reader, backendConn, backendReader)
+}
+
+// handleConnectRequest opens a TCP tunnel to the CONNECT request's authority (host:port), provided
+// the port is allowed by -connect-ports and a route matches the host. The tunnel connects to the
+// route's upstream, i.e. its address and port replace those requested, if set.
+func (proxy *Instance) handleConnectRequest(w http.ResponseWriter, clientRequest *http.Request, cfg *runtimeConfig, lc *listenerConfig) {
+	_, port, err := net.SplitHostPort(clientRequest.Host)
+	if err != nil {
+		http.Error(w, "CONNECT requires host:port", http.StatusBadRequest)
+		return
+	}
+	if !cfg.connectPorts[port] {
+		http.Error(w, fmt.Sprintf("CONNECT to port %s is not allowed", port), http.StatusForbidden)
+		return
+	}
+	rt := lc.routes.match(clientRequest.Host)
+	if rt == nil {
+		http.Error(w, fmt.Sprintf("uds-proxy: no route for host %q", clientRequest.Host), http.StatusMisdirectedRequest)
+		return
+	}
+	// routes restricted to certain peers must not be reachable through CONNECT, either
+	peer := requestPeer(clientRequest)
+	if !rt.allows(peer) {
+		http.Error(w, fmt.Sprintf("uds-proxy: route %q denies access to %s", rt.Name, peer), http.StatusForbidden)
+		return
+	}
+	proxy.countPeerRequest(peer, lc.Name, rt.Name)
+
+	backendConn, err := rt.dialTCP(rt.upstreamHost(clientRequest.Host))
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer backendConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support CONNECT", http.StatusInternalServerError)
+		return
+	}
+	clientConn, clientBuffer, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("connect: hijacking client connection failed: %s", err)
+		return
+	}
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Time{})
+
+	clientBuffer.WriteString("HTTP/1.1 200 Connection established\r\nX-Response-Via: uds-proxy\r\n\r\n")
+	if err = clientBuffer.Flush(); err != nil {
+		log.Printf("connect: writing response failed: %s", err)
+		return
+	}
+
+	proxy.tunnel("connect", clientConn, clientBuffer.Reader, backendConn, backendConn)
+}
+
+// dial connects to a backend for tunnelled connections, using the same TLS
+// settings as the route's HTTP client when scheme, as resolved by targetURL, is https.
+func (rt *route) dial(scheme, hostPort string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	if scheme != "https" {
+		return rt.dialTCP(net.JoinHostPort(host, port))
+	}
+	tlsConfig := &tls.Config{}
+	if rt.tlsConfig != nil {
+		tlsConfig = rt.tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	tlsConfig.NextProtos = []string{"http/1.1"} // the transport may have added h2, tunnels speak HTTP/1.1
+	ctx, cancel := context.WithTimeout(context.Background(), rt.timeout)
+	defer cancel()
+	conn, err := rt.dialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTCP opens a plain TCP connection to hostPort.
+func (rt *route) dialTCP(hostPort string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rt.timeout)
+	defer cancel()
+	return rt.dialContext(ctx, "tcp", hostPort)
+}
+
+// tunnel copies bytes between client and backend in both directions until one side is done.
+// The readers may hold data already buffered from the respective connection.
+func (proxy *Instance) tunnel(kind string, clientConn net.Conn, clientReader io.Reader, backendConn net.Conn, backendReader io.Reader) {
+	if proxy.metrics.enabled {
+		proxy.metrics.TunnelsInflight.WithLabelValues(kind).Inc()
+		defer proxy.metrics.TunnelsInflight.WithLabelValues(kind).Dec()
+		start := time.Now()
+		defer func() {
+			proxy.metrics.TunnelsDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		}()
+	}
+
+	proxy.trackTunnel(clientConn, true)
+	defer proxy.trackTunnel(clientConn, false)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src io.Reader, direction string) {
+		var w io.Writer = dst
+		if proxy.metrics.enabled {
+			w = &countingWriter{Writer: dst, counter: proxy.metrics.TunnelBytes.WithLabelValues(kind, direction)}
+		}
+		io.Copy(w, src)
+		done <- struct{}{}
+	}
+	go pipe(backendConn, clientReader, "upstream")
+	go pipe(clientConn, backendReader, "downstream")
+	<-done
+	clientConn.Close()
+	backendConn.Close()
+	<-done
+}
+
+// countingWriter adds the bytes written to counter as they pass, so that long-lived tunnels are
+// accounted for while they are open.
+type countingWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+func (proxy *Instance) trackTunnel(clientConn net.Conn, open bool) {
+	proxy.tunnelsMutex.Lock()
+	defer proxy.tunnelsMutex.Unlock()
+	if open {
+		proxy.tunnels[clientConn] = struct{}{}
+	} else {
+		delete(proxy.tunnels, clientConn)
+	}
+}
+
+// closeTunnels aborts all open tunnels, which http.Server.Close() does not know about.
+func (proxy *Instance) closeTunnels() {
+	proxy.tunnelsMutex.Lock()
+	defer proxy.tunnelsMutex.Unlock()
+	for conn := range proxy.tunnels {
+		conn.Close()
+	}
+}
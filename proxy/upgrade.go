@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// envListenFDs and envReadyFD tell a process started by Upgrade() which inherited file
+	// descriptors hold the listening sockets and the readiness pipe, respectively.
+	envListenFDs = EnvPrefix + "LISTEN_FDS"
+	envReadyFD   = EnvPrefix + "READY_FD"
+
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+// inheritedSocket describes a listening socket passed on by Upgrade(), JSON-encoded in envListenFDs.
+type inheritedSocket struct {
+	Socket  string `json:"socket"`
+	FD      int    `json:"fd"`
+	Systemd bool   `json:"systemd,omitempty"`
+	TCP     bool   `json:"tcp,omitempty"`
+}
+
+// Upgrade starts a new uds-proxy process from the executable at os.Args[0], using the same arguments,
+// and passes the listening sockets to it. Once the new process reports to be serving, Upgrade returns
+// and the caller is expected to Shutdown() this instance, which then drains without removing the
+// sockets or pid file. If the new process fails to come up, this instance keeps serving.
+// It is invoked on SIGUSR2.
+func (proxy *Instance) Upgrade() error {
+	proxy.listenerMutex.Lock()
+	listeners := proxy.listeners
+	proxy.listenerMutex.Unlock()
+	if listeners == nil {
+		return fmt.Errorf("upgrade: not listening yet")
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("upgrade: %s", err)
+	}
+	defer readyReader.Close()
+	files := []*os.File{readyWriter} // become fds 3 and following
+	var sockets []inheritedSocket
+	for _, l := range listeners {
+		file, err := l.Listener.(filer).File()
+		if err != nil {
+			readyWriter.Close()
+			return fmt.Errorf("upgrade: %s", err)
+		}
+		defer file.Close()
+		sockets = append(sockets, inheritedSocket{Socket: l.path, FD: 3 + len(files), Systemd: l.systemd, TCP: l.tcp})
+		files = append(files, file)
+	}
+	encodedSockets, _ := json.Marshal(sockets)
+
+	executable, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		readyWriter.Close()
+		return fmt.Errorf("upgrade: %s", err)
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(upgradeEnviron(), envReadyFD+"=3", envListenFDs+"="+string(encodedSockets))
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: starting %s: %s", executable, err)
+	}
+	log.Printf("upgrade: started %s as pid %d, waiting for it to become ready", executable, cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyReader).ReadString('\n')
+		if err != nil || line != "ready\n" {
+			err = fmt.Errorf("new process exited before becoming ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("new process not ready within %s", upgradeReadyTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgrade: %s, continuing to serve", err)
+	}
+	go cmd.Wait() // reap the new process should it exit before this one
+
+	// the socket files now belong to the new process
+	proxy.handedOver = true
+	log.Printf("upgrade: pid %d took over %d socket(s)", cmd.Process.Pid, len(listeners))
+	return nil
+}
+
+// inheritedListeners returns the listening sockets passed by a process running Upgrade(), by path.
+func inheritedListeners() (map[string]*socketListener, error) {
+	value := os.Getenv(envListenFDs)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(envListenFDs) // must not leak into later upgrades
+	var sockets []inheritedSocket
+	if err := json.Unmarshal([]byte(value), &sockets); err != nil {
+		return nil, fmt.Errorf("%s: %s", envListenFDs, err)
+	}
+	listeners := make(map[string]*socketListener)
+	for _, socket := range sockets {
+		if socket.FD < 3 {
+			return listeners, fmt.Errorf("%s: invalid file descriptor %d", envListenFDs, socket.FD)
+		}
+		l, err := fileListener(os.NewFile(uintptr(socket.FD), socket.Socket))
+		if err != nil {
+			return listeners, fmt.Errorf("%s: %s: %s", envListenFDs, socket.Socket, err)
+		}
+		listeners[socket.Socket] = &socketListener{Listener: l, path: socket.Socket, systemd: socket.Systemd, tcp: socket.TCP}
+	}
+	return listeners, nil
+}
+
+// filer is implemented by *net.UnixListener and *net.TCPListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// fileListener returns the UNIX domain or TCP stream socket listening on file, which is closed.
+func fileListener(file *os.File) (net.Listener, error) {
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	switch listener.(type) {
+	case *net.UnixListener, *net.TCPListener:
+		return listener, nil
+	}
+	listener.Close()
+	return nil, fmt.Errorf("not a UNIX domain or TCP stream socket")
+}
+
+// notifyUpgradeReady tells a process running Upgrade() that this process is serving.
+func notifyUpgradeReady() {
+	fd, err := inheritedFD(envReadyFD)
+	if fd == nil || err != nil {
+		return
+	}
+	fd.WriteString("ready\n")
+	fd.Close()
+}
+
+func inheritedFD(env string) (*os.File, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(env) // must not leak into later upgrades
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 3 {
+		return nil, fmt.Errorf("%s: invalid file descriptor %q", env, value)
+	}
+	return os.NewFile(uintptr(fd), env), nil
+}
+
+// upgradeEnviron returns the environment for a process started by Upgrade(). WATCHDOG_PID is
+// dropped as the new process takes over sending watchdog pings once it is the main process.
+func upgradeEnviron() (env []string) {
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "WATCHDOG_PID=") {
+			env = append(env, v)
+		}
+	}
+	return
+}
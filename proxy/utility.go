@@ -3,21 +3,56 @@ package proxy
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 func sigHandler(c chan os.Signal, env *Instance) {
 	for sig := range c {
+		if sig == syscall.SIGHUP {
+			env.Reload()
+			continue
+		}
+		if sig == syscall.SIGUSR2 {
+			if err := env.Upgrade(); err != nil {
+				log.Print(err)
+				continue
+			}
+		}
 		println()
 		env.Shutdown(sig)
 		os.Exit(0)
 	}
 }
 
+// writePidFile atomically replaces pidFilePath, so readers never see an empty or partial file.
 func writePidFile(pidFilePath string) error {
 	if pidFilePath == "" {
 		return nil
 	}
 	data := []byte(fmt.Sprintf("%d", os.Getpid()))
-	return ioutil.WriteFile(pidFilePath, data, 0644)
+	tmpFile := fmt.Sprintf("%s.%d.tmp", pidFilePath, os.Getpid())
+	if err := ioutil.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, pidFilePath)
+}
+
+// parsePortList parses a comma-separated list of TCP ports like "443,8443" into a set.
+func parsePortList(list string) (map[string]bool, error) {
+	ports := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ports[strconv.Itoa(n)] = true
+	}
+	return ports, nil
 }
@@ -3,15 +3,36 @@
 package proxy_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"gotest.tools/assert"
 
 	"github.com/schnoddelbotz/uds-proxy/proxy"
@@ -77,11 +98,15 @@ func Test_BadHostnameYields502(t *testing.T) {
 }
 
 func Test_MetricsExported(t *testing.T) {
-	_, headersNoProxy, responseCode, err := httpGet(metricsURL, nil)
+	_, _, _, err := httpGet(fakeServerBaseURL+"/", testProxy)
+	assert.NilError(t, err)
+	metrics, headersNoProxy, responseCode, err := httpGet(metricsURL, nil)
 
 	assert.NilError(t, err)
 	assert.Equal(t, headersNoProxy.Get("X-Response-Via"), "")
 	assert.Equal(t, responseCode, 200, "uds-proxy should provide /metrics on -prometheus-port")
+	assert.Assert(t, strings.Contains(string(metrics),
+		fmt.Sprintf(`udsproxy_peer_requests_total{listener="default",route="default",uid="%d"}`, os.Getuid())), "-metrics-peer-uid counts by uid")
 	// tbd: match expected metrics
 }
 
@@ -114,6 +139,1171 @@ func Test_ProxyPreservesResponseHeaders(t *testing.T) {
 	httpsEnforcingProxy.Shutdown(nil)
 }
 
+func Test_RepeatedResponseHeadersAreForwarded(t *testing.T) {
+	body, header, responseCode, err := httpGet(fakeServerBaseURL+"/headers/repeated", testProxy)
+
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+	assert.Equal(t, string(body), "REPEATED-HEADERS-OK")
+	assert.DeepEqual(t, header["Set-Cookie"], []string{"session=abc; Path=/", "theme=dark; Path=/"})
+	assert.DeepEqual(t, header["Vary"], []string{"Accept-Encoding", "Accept-Language"})
+	assert.Equal(t, header.Get("X-Hop-Only"), "", "headers named in Connection are hop-by-hop")
+	assert.Equal(t, header.Get("Proxy-Authenticate"), "", "Proxy-* headers are hop-by-hop")
+}
+
+func Test_ResponseTrailersAreForwarded(t *testing.T) {
+	response, err := udsClient(testProxy).Get(fakeServerBaseURL + "/trailers")
+	assert.NilError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "TRAILERS-OK")
+	assert.Equal(t, response.Trailer.Get("X-Checksum"), "c0ffee")
+	assert.Equal(t, response.Trailer.Get("X-Unannounced"), "surprise")
+}
+
+func Test_EventStreamIsNotBuffered(t *testing.T) {
+	start := time.Now()
+	response, err := udsClient(testProxy).Get(fakeServerBaseURL + "/stream/3/300")
+	assert.NilError(t, err)
+	defer response.Body.Close()
+	firstEvent, err := bufio.NewReader(response.Body).ReadString('\n')
+
+	assert.NilError(t, err)
+	assert.Equal(t, firstEvent, "data: event-0\n")
+	assert.Assert(t, time.Since(start) < 250*time.Millisecond, "first event must arrive before stream ends")
+}
+
+func Test_EventStreamOutlivesClientAndWriteTimeouts(t *testing.T) {
+	streamingProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: "uds-proxy-stream.sock",
+		ClientTimeout: 500, SocketWriteTimeout: 500, NoAccessLog: true})
+	go streamingProxy.Run()
+	defer streamingProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	for _, proxyInstance := range []*proxy.Instance{testProxy, streamingProxy} {
+		start := time.Now()
+		body, _, responseCode, err := httpGet(fakeServerBaseURL+"/stream/5/300", proxyInstance)
+		assert.NilError(t, err)
+		assert.Equal(t, responseCode, 200)
+		assert.Assert(t, strings.Contains(string(body), "data: event-4\n"), "stream was cut: %q", body)
+		assert.Assert(t, time.Since(start) > time.Duration(proxyInstance.Options.ClientTimeout)*time.Millisecond)
+	}
+}
+
+func Test_UpgradedConnectionIsTunnelled(t *testing.T) {
+	conn, err := net.Dial("unix", testProxy.Options.SocketPath)
+	assert.NilError(t, err)
+	defer conn.Close()
+	request, _ := http.NewRequest("GET", fakeServerBaseURL+"/upgrade/echo", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "echo")
+	assert.NilError(t, request.Write(conn))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	assert.NilError(t, err)
+	assert.Equal(t, response.StatusCode, http.StatusSwitchingProtocols)
+	assert.Equal(t, response.Header.Get("Upgrade"), "echo")
+
+	// tunnel must outlive the proxy's client timeout
+	time.Sleep(time.Duration(testProxy.Options.ClientTimeout+100) * time.Millisecond)
+	_, err = conn.Write([]byte("ping\n"))
+	assert.NilError(t, err)
+	echo, err := reader.ReadString('\n')
+	assert.NilError(t, err)
+	assert.Equal(t, echo, "ping\n")
+}
+
+func Test_UpgradeRefusedByBackendIsForwarded(t *testing.T) {
+	request, _ := http.NewRequest("GET", fakeServerBaseURL+"/upgrade/echo", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	response, err := udsClient(testProxy).Do(request)
+	assert.NilError(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, response.StatusCode, http.StatusUpgradeRequired)
+}
+
+func Test_UpgradeOfHTTPSRequestIsTunnelledViaTLS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.DefaultServeMux) // the fake server's handlers
+	defer upstream.Close()
+	caFile := filepath.Join(os.TempDir(), "uds-proxy-upgrade-ca.pem")
+	defer os.Remove(caFile)
+	assert.NilError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+	defer withRoutes(t, proxy.Route{Host: "upgrade.test", Address: "127.0.0.1", Port: upstreamPort(upstream),
+		TLSCA: caFile})()
+
+	conn, err := net.Dial("unix", testProxy.Options.SocketPath)
+	assert.NilError(t, err)
+	defer conn.Close()
+	request, _ := http.NewRequest("GET", "https://upgrade.test/upgrade/echo", nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "echo")
+	assert.NilError(t, request.WriteProxy(conn)) // absolute-form, the route has no scheme of its own
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	assert.NilError(t, err)
+	assert.Equal(t, response.StatusCode, http.StatusSwitchingProtocols)
+	_, err = conn.Write([]byte("ping\n"))
+	assert.NilError(t, err)
+	echo, err := reader.ReadString('\n')
+	assert.NilError(t, err)
+	assert.Equal(t, echo, "ping\n")
+}
+
+func Test_ConnectTunnelsToAllowedPort(t *testing.T) {
+	downstreamBytes := func() float64 {
+		value, _ := strconv.ParseFloat(metricValue(t, `udsproxy_tunnel_bytes_total{direction="downstream",kind="connect"}`), 64)
+		return value
+	}
+	before := downstreamBytes()
+	conn, err := net.Dial("unix", testProxy.Options.SocketPath)
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT localhost" + fakeServerPort + " HTTP/1.1\r\nHost: localhost" + fakeServerPort + "\r\n\r\n"))
+	assert.NilError(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	assert.NilError(t, err)
+	assert.Equal(t, response.StatusCode, 200)
+
+	// talk plain HTTP to the fake server through the tunnel
+	request, _ := http.NewRequest("GET", fakeServerBaseURL+"/", nil)
+	assert.NilError(t, request.Write(conn))
+	response, err = http.ReadResponse(reader, request)
+	assert.NilError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, string(body), "ROOT-INDEX-OK")
+	assert.Equal(t, response.Header.Get("X-Response-Via"), "", "tunnelled traffic is not touched")
+	assert.Assert(t, downstreamBytes()-before > float64(len(body)), "bytes are counted while the tunnel is open")
+	assert.Equal(t, metricValue(t, fmt.Sprintf(`udsproxy_peer_requests_total{listener="default",route="connect",uid="%d"}`,
+		os.Getuid())), "", "CONNECT requests are counted by their route")
+}
+
+func Test_ConnectToDisallowedPortIsForbidden(t *testing.T) {
+	conn, err := net.Dial("unix", testProxy.Options.SocketPath)
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("CONNECT localhost:22 HTTP/1.1\r\nHost: localhost:22\r\n\r\n"))
+	assert.NilError(t, err)
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	assert.NilError(t, err)
+	assert.Equal(t, response.StatusCode, http.StatusForbidden)
+}
+
+func Test_RoutesSelectUpstreamByHost(t *testing.T) {
+	routedProxy := proxy.NewProxyInstance(proxy.Settings{
+		SocketPath:    "uds-proxy-routes.sock",
+		ClientTimeout: 1000,
+		ConnectPorts:  "25777",
+		Routes: []proxy.Route{
+			{Host: "exact.test", Address: "localhost", Port: 25777},
+			{Host: "*.wildcard.test", Address: "localhost", Port: 25777, HostOverride: "overridden.test"},
+			{Host: "~^regex[0-9]+\\.test$", Address: "127.0.0.1", Port: 25777},
+		},
+	})
+	go routedProxy.Run()
+	defer routedProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	body, _, responseCode, err := httpGet("http://exact.test/echo/host", routedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+	assert.Equal(t, string(body), "exact.test", "client's Host header is kept")
+
+	body, _, responseCode, err = httpGet("http://a.wildcard.test/echo/host", routedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+	assert.Equal(t, string(body), "overridden.test")
+
+	body, _, responseCode, err = httpGet("http://regex42.test/", routedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+	assert.Equal(t, string(body), "ROOT-INDEX-OK")
+
+	_, _, responseCode, err = httpGet("http://unrouted.test/", routedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, http.StatusMisdirectedRequest, "hosts without route yield 421")
+
+	assert.Equal(t, connect(t, routedProxy, "exact.test:25777"), 200, "CONNECT dials the route's address")
+	assert.Equal(t, connect(t, routedProxy, "unrouted.test:25777"), http.StatusMisdirectedRequest,
+		"CONNECT to hosts without route yields 421, too")
+}
+
+func Test_RoutesRestrictedToPeerCredentials(t *testing.T) {
+	restrictedProxy := proxy.NewProxyInstance(proxy.Settings{
+		SocketPath:    "uds-proxy-peercred.sock",
+		ClientTimeout: 1000,
+		ConnectPorts:  "25777",
+		Routes: []proxy.Route{
+			{Host: "by-uid.test", Address: "localhost", Port: 25777, AllowUIDs: []int{os.Getuid()}},
+			{Host: "by-gid.test", Address: "localhost", Port: 25777, AllowUIDs: []int{os.Getuid() + 1}, AllowGIDs: []int{os.Getgid()}},
+			{Host: "denied.test", Address: "localhost", Port: 25777, AllowUIDs: []int{os.Getuid() + 1}, AllowGIDs: []int{os.Getgid() + 1}},
+		},
+	})
+	go restrictedProxy.Run()
+	defer restrictedProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	_, _, responseCode, err := httpGet("http://by-uid.test/", restrictedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+
+	_, _, responseCode, err = httpGet("http://by-gid.test/", restrictedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+
+	body, _, responseCode, err := httpGet("http://denied.test/", restrictedProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, http.StatusForbidden)
+	assert.Assert(t, strings.Contains(string(body), fmt.Sprintf("uid=%d", os.Getuid())), string(body))
+
+	assert.Equal(t, connect(t, restrictedProxy, "by-uid.test:25777"), 200)
+	assert.Equal(t, connect(t, restrictedProxy, "denied.test:25777"), http.StatusForbidden,
+		"restricted routes cannot be reached through CONNECT")
+	assert.Equal(t, connect(t, restrictedProxy, "unrouted.test:25777"), http.StatusMisdirectedRequest,
+		"a denied peer cannot fall through to a host matching no route")
+}
+
+func Test_ListenersServeWithTheirOwnSettings(t *testing.T) {
+	multiProxy := proxy.NewProxyInstance(proxy.Settings{
+		SocketPath:    "uds-proxy-multi.sock",
+		ClientTimeout: 1000,
+		Listeners: []proxy.Listener{
+			{Name: "pinned", Socket: "uds-proxy-multi-pinned.sock", Address: "localhost", Port: 25777},
+			{Socket: "uds-proxy-multi-slow.sock", ClientTimeout: 100,
+				Routes: []proxy.Route{{Host: "slow.test", Address: "localhost", Port: 25777}}},
+			{Name: "restricted", Socket: "uds-proxy-multi-restricted.sock", AllowUIDs: []int{os.Getuid() + 1}},
+		},
+	})
+	go multiProxy.Run()
+	time.Sleep(250 * time.Millisecond)
+	get := func(socket, url string) (string, int) {
+		response, err := socketClient(socket).Get(url)
+		assert.NilError(t, err)
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		return string(body), response.StatusCode
+	}
+
+	body, code := get("uds-proxy-multi.sock", fakeServerBaseURL+"/slow/200/300")
+	assert.Equal(t, code, 200, "default listener keeps global timeout")
+	body, code = get("uds-proxy-multi-pinned.sock", "http://any.test/")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, body, "ROOT-INDEX-OK", "listener forwards to its default upstream")
+	_, code = get("uds-proxy-multi-slow.sock", "http://slow.test/slow/200/300")
+	assert.Equal(t, code, http.StatusGatewayTimeout, "listener applies its own client-timeout")
+	_, code = get("uds-proxy-multi-slow.sock", fakeServerBaseURL+"/")
+	assert.Equal(t, code, http.StatusMisdirectedRequest, "listener uses its own routes")
+	body, code = get("uds-proxy-multi-restricted.sock", fakeServerBaseURL+"/")
+	assert.Equal(t, code, http.StatusForbidden, body)
+
+	multiProxy.Shutdown(nil)
+	for _, socket := range []string{"uds-proxy-multi.sock", "uds-proxy-multi-pinned.sock", "uds-proxy-multi-slow.sock"} {
+		_, err := os.Stat(socket)
+		assert.Assert(t, os.IsNotExist(err), "%s is removed on shutdown", socket)
+	}
+}
+
+func Test_TCPListenerServesProxyClients(t *testing.T) {
+	const tcpAddress = "127.0.0.1:25780"
+	tcpProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: "uds-proxy-tcp.sock", ListenTCP: tcpAddress,
+		ClientTimeout: 1000})
+	go tcpProxy.Run()
+	defer tcpProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	proxyURL, _ := url.Parse("http://" + tcpAddress)
+	explicitProxyClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	response, err := explicitProxyClient.Get(fakeServerBaseURL + "/")
+	assert.NilError(t, err)
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, response.StatusCode, 200)
+	assert.Equal(t, string(body), "ROOT-INDEX-OK", "absolute-form request URIs are supported")
+	assert.Equal(t, response.Header.Get("X-Response-Via"), "uds-proxy")
+
+	request, _ := http.NewRequest("GET", "http://"+tcpAddress+"/echo/host", nil)
+	request.Host = "localhost" + fakeServerPort
+	response, err = http.DefaultClient.Do(request)
+	assert.NilError(t, err)
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, response.StatusCode, 200)
+	assert.Equal(t, string(body), "localhost"+fakeServerPort, "origin-form requests are routed by Host")
+}
+
+func Test_UpstreamMutualTLSReloadsClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uds-proxy-tls")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCertificate(t, "uds-proxy test CA", time.Hour, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	ca.write(t, caFile, "")
+
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close") // next request performs a new handshake
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server := newTestCertificate(t, "localhost", time.Hour, ca)
+	upstream.TLS = &tls.Config{Certificates: []tls.Certificate{server.keyPair()},
+		ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: ca.pool()}
+	upstream.StartTLS()
+	defer upstream.Close()
+	port := upstreamPort(upstream)
+	expiry := func() string {
+		return metricValue(t, fmt.Sprintf(`udsproxy_upstream_cert_expiry_timestamp_seconds{cert="%s"}`, certFile))
+	}
+
+	first := newTestCertificate(t, "client-1", time.Hour, ca)
+	first.write(t, certFile, keyFile)
+	defer withRoutes(t,
+		proxy.Route{Host: "mtls.test", Scheme: "https", Address: "127.0.0.1", Port: port, SNI: "localhost",
+			TLSCA: caFile, TLSCert: certFile, TLSKey: keyFile, TLSMinVersion: "1.2"},
+		proxy.Route{Host: "no-cert.test", Scheme: "https", Address: "127.0.0.1", Port: port, SNI: "localhost", TLSCA: caFile},
+	)()
+	body, _, code, err := httpGet("http://mtls.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200, string(body))
+	assert.Equal(t, string(body), "client-1")
+	assert.Equal(t, expiry(), strconv.FormatFloat(float64(first.certificate.NotAfter.Unix()), 'g', -1, 64))
+
+	second := newTestCertificate(t, "client-2", 2*time.Hour, ca)
+	second.write(t, certFile, keyFile)
+	time.Sleep(1100 * time.Millisecond)
+	body, _, code, err = httpGet("http://mtls.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200, string(body))
+	assert.Equal(t, string(body), "client-2", "changed certificate is used without reload")
+	assert.Equal(t, expiry(), strconv.FormatFloat(float64(second.certificate.NotAfter.Unix()), 'g', -1, 64))
+
+	_, _, code, err = httpGet("http://no-cert.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, http.StatusBadGateway, "upstream is not reachable without client certificate")
+}
+
+func Test_UpstreamHTTP2MultiplexesRequests(t *testing.T) {
+	var mutex sync.Mutex
+	var inflight, maxInflight int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		if inflight++; inflight > maxInflight {
+			maxInflight = inflight
+		}
+		mutex.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mutex.Lock()
+		inflight--
+		mutex.Unlock()
+		fmt.Fprint(w, r.Proto)
+	})
+	tlsUpstream := httptest.NewUnstartedServer(handler)
+	tlsUpstream.EnableHTTP2 = true
+	tlsUpstream.StartTLS()
+	defer tlsUpstream.Close()
+	cleartextUpstream := httptest.NewUnstartedServer(handler)
+	cleartextUpstream.Config.Protocols = new(http.Protocols)
+	cleartextUpstream.Config.Protocols.SetHTTP1(true)
+	cleartextUpstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	cleartextUpstream.Start()
+	defer cleartextUpstream.Close()
+
+	caFile := filepath.Join(os.TempDir(), "uds-proxy-h2-ca.pem")
+	defer os.Remove(caFile)
+	assert.NilError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsUpstream.Certificate().Raw}), 0600))
+	defer withRoutes(t,
+		proxy.Route{Host: "h2.test", Scheme: "https", Address: "127.0.0.1", Port: upstreamPort(tlsUpstream),
+			SNI: "example.com", TLSCA: caFile, UpstreamProtocol: "h2", H2PingInterval: 1000},
+		proxy.Route{Host: "h2c.test", Address: "127.0.0.1", Port: upstreamPort(cleartextUpstream),
+			UpstreamProtocol: "h2c", H2MaxConcurrentStreams: 2},
+		proxy.Route{Host: "http1.test", Address: "127.0.0.1", Port: upstreamPort(cleartextUpstream)},
+	)()
+
+	for host, proto := range map[string]string{"h2.test": "HTTP/2.0", "h2c.test": "HTTP/2.0", "http1.test": "HTTP/1.1"} {
+		body, _, code, err := httpGet("http://"+host+"/", testProxy)
+		assert.NilError(t, err)
+		assert.Equal(t, code, 200, string(body))
+		assert.Equal(t, string(body), proto, host)
+	}
+
+	mutex.Lock()
+	maxInflight = 0
+	mutex.Unlock()
+	codes := make(chan int)
+	for i := 0; i < 6; i++ {
+		go func() {
+			_, _, code, _ := httpGet("http://h2c.test/", testProxy)
+			codes <- code
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		assert.Equal(t, <-codes, 200)
+	}
+	assert.Equal(t, maxInflight, 2, "h2-max-concurrent-streams limits requests in flight")
+	assert.Assert(t, metricValue(t,
+		`udsproxy_upstream_requests_total{listener="default",protocol="HTTP/2.0",route="h2c.test"}`) != "", "protocol is reported")
+}
+
+func Test_GRPCPassesThroughH2CSocket(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		// like gRPC servers, send the status as trailer that was not announced
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "5")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "no such thing")
+	}))
+	upstream.Config.Protocols = new(http.Protocols)
+	upstream.Config.Protocols.SetUnencryptedHTTP2(true)
+	upstream.Start()
+	defer upstream.Close()
+	route := proxy.Route{Host: "grpc.test", Address: "127.0.0.1", Port: upstreamPort(upstream), UpstreamProtocol: "h2c"}
+	defer withRoutes(t, route)()
+	grpcProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: "uds-proxy-grpc.sock", SocketH2C: true,
+		SocketReadTimeout: 500, NoAccessLog: true, Routes: []proxy.Route{route}})
+	go grpcProxy.Run()
+	defer grpcProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	for _, proxyInstance := range []*proxy.Instance{testProxy, grpcProxy} {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", proxyInstance.Options.SocketPath)
+			},
+			Protocols: new(http.Protocols),
+		}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+		defer transport.CloseIdleConnections()
+		// a client stream lasting longer than socket-read-timeout
+		requestBody, writer := io.Pipe()
+		go func() {
+			for i := 0; i < 4; i++ {
+				writer.Write([]byte("\x00\x00\x00\x00\x00"))
+				time.Sleep(200 * time.Millisecond)
+			}
+			writer.Close()
+		}()
+		request, _ := http.NewRequest("POST", "http://grpc.test/test.Service/Get", requestBody)
+		request.Header.Set("Content-Type", "application/grpc")
+		request.Header.Set("Te", "trailers")
+		response, err := transport.RoundTrip(request)
+		assert.NilError(t, err)
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		assert.NilError(t, err)
+
+		assert.Equal(t, response.Proto, "HTTP/2.0")
+		assert.Equal(t, string(body), strings.Repeat("\x00", 20), "client stream was cut")
+		assert.Equal(t, response.Trailer.Get("Grpc-Status"), "5")
+		assert.Equal(t, response.Trailer.Get("Grpc-Message"), "no such thing")
+	}
+	assert.Assert(t, metricValue(t,
+		`udsproxy_grpc_requests_total{grpc_code="NOT_FOUND",listener="default",route="grpc.test"}`) != "", "status is counted")
+}
+
+func Test_DNSCacheHonoursTTLAndServesStaleAnswers(t *testing.T) {
+	var failing int32
+	dnsServer, queries := runFakeDNSServer(t, map[string]string{"cached.test.": "127.0.0.1"}, &failing)
+	settings := testProxy.Options
+	settings.DNSCache = true
+	settings.DNSServers = dnsServer
+	settings.DNSStaleTTL = 60000
+	defer withSettings(t, settings, proxy.Route{Host: "*.test", Port: 25777})()
+	// each reload starts with new connection pools, so that requests dial again
+	get := func(url string) int {
+		assert.NilError(t, testProxy.Reload())
+		_, _, code, err := httpGet(url, testProxy)
+		assert.NilError(t, err)
+		return code
+	}
+
+	assert.Equal(t, get("http://cached.test/"), 200)
+	assert.Equal(t, atomic.LoadInt32(queries), int32(2), "A and AAAA are queried")
+	assert.Equal(t, get("http://cached.test/"), 200)
+	assert.Equal(t, atomic.LoadInt32(queries), int32(2), "answer is cached for its TTL")
+	assert.Equal(t, get("http://unknown.test/"), 502)
+
+	time.Sleep(1100 * time.Millisecond)
+	atomic.StoreInt32(&failing, 1)
+	assert.Equal(t, get("http://cached.test/"), 200, "expired answer is used while the server fails")
+	assert.Equal(t, atomic.LoadInt32(queries), int32(6))
+	for _, result := range []string{"hit", "miss", "stale"} {
+		assert.Assert(t, metricValue(t, `udsproxy_dns_cache_lookups_total{result="`+result+`"}`) != "", result)
+	}
+}
+
+func Test_HostOverridesPinUpstreamAddress(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.TLS.ServerName)
+	}))
+	defer upstream.Close()
+	caFile := filepath.Join(os.TempDir(), "uds-proxy-override-ca.pem")
+	defer os.Remove(caFile)
+	assert.NilError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600))
+	settings := testProxy.Options
+	settings.HostOverrides = map[string]string{
+		"pinned.example.com": "127.0.0.1" + fakeServerPort,
+		"example.com:443":    upstream.Listener.Addr().String(),
+	}
+	settings.LogHostOverrides = true
+	defer withSettings(t, settings, proxy.Route{Host: "example.com", Scheme: "https", TLSCA: caFile})()
+
+	body, _, code, err := httpGet("http://pinned.example.com/echo/host", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, string(body), "pinned.example.com", "Host header is kept")
+
+	body, _, code, err = httpGet("http://example.com/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200, string(body))
+	assert.Equal(t, string(body), "example.com example.com", "Host header and SNI are kept")
+}
+
+func Test_RetriesRepeatIdempotentRequests(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		attempts[r.URL.Path]++
+		first := attempts[r.URL.Path] == 1
+		mutex.Unlock()
+		if first { // drop the connection like a backend restarting
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	}))
+	defer upstream.Close()
+	defer withRoutes(t, proxy.Route{Host: "retry.test", Address: "127.0.0.1", Port: upstreamPort(upstream),
+		Retries: 2, RetryBackoff: 10, RetryBufferSize: 1024})()
+	send := func(method, path, body string) (int, string) {
+		request, _ := http.NewRequest(method, "http://retry.test"+path, strings.NewReader(body))
+		response, err := udsClient(testProxy).Do(request)
+		assert.NilError(t, err)
+		defer response.Body.Close()
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(responseBody)
+	}
+
+	code, body := send("GET", "/get", "")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, body, "GET ")
+	code, body = send("PUT", "/put", "payload")
+	assert.Equal(t, code, 200, body)
+	assert.Equal(t, body, "PUT payload", "buffered body is replayed")
+	code, _ = send("POST", "/post", "payload")
+	assert.Equal(t, code, 502, "sent POST requests are not repeated")
+
+	mutex.Lock()
+	assert.DeepEqual(t, attempts, map[string]int{"/get": 2, "/put": 2, "/post": 1})
+	mutex.Unlock()
+	assert.Assert(t, metricValue(t, `udsproxy_retries_total{route="retry.test"}`) != "")
+}
+
+func Test_HedgingAnswersSlowRequestsWithinBudget(t *testing.T) {
+	var slow, hedges int32
+	cancelled := make(chan struct{}, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" && atomic.CompareAndSwapInt32(&slow, 1, 0) {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return
+			}
+		} else if r.URL.Path == "/slow" {
+			atomic.AddInt32(&hedges, 1)
+		}
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	defer withRoutes(t,
+		proxy.Route{Host: "hedge.test", Address: "127.0.0.1", Port: upstreamPort(upstream),
+			HedgePercentile: 90, HedgeBudget: 5, HedgeMinDelay: 50},
+		proxy.Route{Host: "hedge-limited.test", Address: "127.0.0.1", Port: upstreamPort(upstream),
+			HedgePercentile: 90, HedgeBudget: 5, HedgeMinDelay: 50, MaxConcurrency: 1, ConcurrencyQueue: 1,
+			ConcurrencyTimeout: 1000},
+	)()
+	warmUp := func(host string) {
+		for i := 0; i < 20; i++ { // observe latencies, saving up 5% of 20 requests: one hedge
+			_, _, code, err := httpGet("http://"+host+"/fast", testProxy)
+			assert.NilError(t, err)
+			assert.Equal(t, code, 200)
+		}
+	}
+
+	warmUp("hedge.test")
+	atomic.StoreInt32(&slow, 1)
+	start := time.Now()
+	body, _, code, err := httpGet("http://hedge.test/slow", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, string(body), "/slow")
+	assert.Assert(t, time.Since(start) < 400*time.Millisecond, "hedge answers before the slow attempt")
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow attempt was not cancelled")
+	}
+
+	atomic.StoreInt32(&slow, 1)
+	start = time.Now()
+	_, _, code, err = httpGet("http://hedge.test/slow", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200)
+	assert.Assert(t, time.Since(start) >= 500*time.Millisecond, "budget is spent, request is not hedged")
+	assert.Equal(t, atomic.LoadInt32(&hedges), int32(1))
+	assert.Assert(t, metricValue(t, `udsproxy_hedges_sent_total{route="hedge.test"}`) != "")
+	assert.Assert(t, metricValue(t, `udsproxy_hedges_won_total{route="hedge.test"}`) != "")
+
+	warmUp("hedge-limited.test")
+	atomic.StoreInt32(&slow, 1)
+	start = time.Now()
+	_, _, code, err = httpGet("http://hedge-limited.test/slow", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200)
+	assert.Assert(t, time.Since(start) >= 500*time.Millisecond, "no concurrency slot is free, request is not hedged")
+	assert.Equal(t, atomic.LoadInt32(&hedges), int32(1))
+}
+
+func Test_RateLimitsDelayOrRejectRequests(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/busy":
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/overloaded":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	port := upstreamPort(upstream)
+	defer withRoutes(t,
+		proxy.Route{Host: "limited.test", Address: "127.0.0.1", Port: port, RateLimit: "5/s",
+			RateLimitKey: "header:X-Api-Key", RateLimitMode: "reject", RateLimitMaxPause: 60000},
+		proxy.Route{Host: "queued.test", Address: "127.0.0.1", Port: port, RateLimit: "10/s", RateLimitQueueTimeout: 1000},
+		proxy.Route{Host: "capped.test", Address: "127.0.0.1", Port: port, RateLimit: "100/s",
+			RateLimitKey: "header:X-Api-Key", RateLimitMode: "reject", RateLimitMaxPause: 200},
+	)()
+	run := strconv.FormatInt(time.Now().UnixNano(), 10) // buckets outlive reloads
+	send := func(url, key string) (int, http.Header) {
+		request, _ := http.NewRequest("GET", url, nil)
+		request.Header.Set("X-Api-Key", key+run)
+		response, err := udsClient(testProxy).Do(request)
+		assert.NilError(t, err)
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		return response.StatusCode, response.Header
+	}
+
+	code, _ := send("http://limited.test/", "a")
+	assert.Equal(t, code, 200)
+	code, header := send("http://limited.test/", "a")
+	assert.Equal(t, code, 429, "reject mode answers requests exceeding the limit")
+	assert.Equal(t, header.Get("Retry-After"), "1")
+	code, _ = send("http://limited.test/", "b")
+	assert.Equal(t, code, 200, "callers are limited separately")
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		code, _ = send("http://queued.test/", "")
+		assert.Equal(t, code, 200)
+	}
+	assert.Assert(t, time.Since(start) >= 150*time.Millisecond, "queue mode spaces requests out")
+
+	time.Sleep(250 * time.Millisecond)
+	code, _ = send("http://limited.test/busy", "b")
+	assert.Equal(t, code, 429)
+	sent := atomic.LoadInt32(&hits)
+	time.Sleep(250 * time.Millisecond)
+	code, header = send("http://limited.test/", "b")
+	assert.Equal(t, code, 429, "upstream Retry-After pauses the bucket")
+	assert.Equal(t, header.Get("X-Response-Via"), "", "rejected by uds-proxy")
+	assert.Equal(t, atomic.LoadInt32(&hits), sent)
+
+	code, _ = send("http://capped.test/overloaded", "c")
+	assert.Equal(t, code, 503)
+	code, _ = send("http://capped.test/", "c")
+	assert.Equal(t, code, 429, "upstream Retry-After pauses the bucket")
+	time.Sleep(300 * time.Millisecond)
+	code, _ = send("http://capped.test/", "c")
+	assert.Equal(t, code, 200, "pause is limited to rate-limit-max-pause")
+	assert.Assert(t, metricValue(t, `udsproxy_throttled_requests_total{result="rejected",route="limited.test"}`) != "")
+	assert.Assert(t, metricValue(t, `udsproxy_throttled_requests_total{result="delayed",route="queued.test"}`) != "")
+}
+
+func Test_ConcurrencyLimitQueuesAndRejectsRequests(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			arrived <- struct{}{}
+			<-release
+		}
+	}))
+	defer upstream.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	port, failingPort := upstreamPort(upstream), upstreamPort(failing)
+	defer withRoutes(t,
+		proxy.Route{Host: "limited.test", Address: "127.0.0.1", Port: port, MaxConcurrency: 1, ConcurrencyQueue: 1,
+			ConcurrencyTimeout: 300},
+		proxy.Route{Host: "aimd.test", Address: "127.0.0.1", Port: failingPort, MaxConcurrency: 4, ConcurrencyMode: "aimd"},
+	)()
+	upstreamLabel := `{upstream="127.0.0.1:` + strconv.Itoa(port) + `"}`
+	waitForQueue := func() {
+		for i := 0; metricValue(t, "udsproxy_concurrency_queue_depth"+upstreamLabel) != "1"; i++ {
+			assert.Assert(t, i < 100, "request was not queued")
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	get := func(path string, codes chan<- int) {
+		body, _, code, err := httpGet("http://limited.test"+path, testProxy)
+		assert.NilError(t, err, string(body))
+		codes <- code
+	}
+
+	blocking, queued := make(chan int, 1), make(chan int, 1)
+	go get("/block", blocking)
+	<-arrived
+	go get("/", queued)
+	waitForQueue()
+	body, _, code, err := httpGet("http://limited.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 503, "queue is full")
+	assert.Assert(t, strings.Contains(string(body), "1 requests queued"), string(body))
+	assert.Equal(t, <-queued, 503, "queued request times out")
+
+	go get("/", queued)
+	waitForQueue()
+	close(release)
+	assert.Equal(t, <-blocking, 200)
+	assert.Equal(t, <-queued, 200, "finished request hands its slot to the queue")
+	assert.Equal(t, metricValue(t, "udsproxy_concurrency_queue_depth"+upstreamLabel), "0")
+	assert.Assert(t, metricValue(t, `udsproxy_concurrency_rejected_total{reason="queue-full",upstream="127.0.0.1:`+strconv.Itoa(port)+`"}`) != "")
+	assert.Assert(t, metricValue(t, `udsproxy_concurrency_rejected_total{reason="queue-timeout",upstream="127.0.0.1:`+strconv.Itoa(port)+`"}`) != "")
+	assert.Assert(t, metricValue(t, "udsproxy_concurrency_queue_wait_seconds_count"+upstreamLabel) != "")
+
+	impatient := udsClient(testProxy)
+	impatient.Timeout = 100 * time.Millisecond
+	_, err = impatient.Get("http://aimd.test/slow")
+	assert.Assert(t, err != nil, "client gives up")
+	limit := `udsproxy_concurrency_limit{upstream="127.0.0.1:` + strconv.Itoa(failingPort) + `"}`
+	for i := 0; metricValue(t, limit) == ""; i++ {
+		assert.Assert(t, i < 100, "cancelled request did not finish")
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, metricValue(t, limit), "4", "requests cancelled by their client do not decrease the limit")
+
+	_, _, code, err = httpGet("http://aimd.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 500)
+	assert.Equal(t, metricValue(t, limit), "3", "aimd mode decreases the limit on failures")
+}
+
+func Test_CircuitBreakerFailsFastWhileOpen(t *testing.T) {
+	var failing, hits int32 = 1, 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if atomic.LoadInt32(&failing) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+	port := upstreamPort(upstream)
+	defer withRoutes(t, proxy.Route{Host: "breaker.test", Address: "127.0.0.1", Port: port,
+		BreakerFailures: 2, BreakerOpenTime: 300})()
+	breakerState := `udsproxy_circuit_breaker_state{upstream="127.0.0.1:` + strconv.Itoa(port) + `"}`
+
+	for i := 0; i < 2; i++ {
+		_, _, code, err := httpGet("http://breaker.test/", testProxy)
+		assert.NilError(t, err)
+		assert.Equal(t, code, 500)
+	}
+	body, header, code, err := httpGet("http://breaker.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 503)
+	assert.Equal(t, header.Get("X-Circuit-Breaker"), "open")
+	assert.Equal(t, header.Get("Retry-After"), "1")
+	assert.Assert(t, strings.Contains(string(body), "2 consecutive failures"), string(body))
+	assert.Equal(t, atomic.LoadInt32(&hits), int32(2), "requests fail fast while open")
+	assert.Equal(t, metricValue(t, breakerState), "2")
+
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(350 * time.Millisecond)
+	_, _, code, err = httpGet("http://breaker.test/", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200, "probe request passes once half-open")
+	assert.Equal(t, metricValue(t, breakerState), "0", "successful probe closes the breaker")
+}
+
+func Test_CircuitBreakerIgnoresCancelledRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(500 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer upstream.Close()
+	port := upstreamPort(upstream)
+	defer withRoutes(t, proxy.Route{Host: "impatient.test", Address: "127.0.0.1", Port: port,
+		BreakerFailures: 2, BreakerOpenTime: 5000})()
+
+	impatient := udsClient(testProxy)
+	impatient.Timeout = 100 * time.Millisecond
+	for i := 0; i < 2; i++ {
+		_, err := impatient.Get("http://impatient.test/slow")
+		assert.Assert(t, err != nil, "client gives up")
+	}
+	time.Sleep(100 * time.Millisecond) // for the proxy to notice
+	_, header, code, err := httpGet("http://impatient.test/fast", testProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200, "cancelled requests are no upstream failures")
+	assert.Equal(t, header.Get("X-Circuit-Breaker"), "")
+	assert.Equal(t, metricValue(t, `udsproxy_circuit_breaker_state{upstream="127.0.0.1:`+strconv.Itoa(port)+`"}`), "0")
+}
+
+func Test_CircuitBreakerProbeAloneDecidesWhileHalfOpen(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			time.Sleep(600 * time.Millisecond)
+		}
+		if strings.HasSuffix(r.URL.Path, "fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+	port := upstreamPort(upstream)
+	defer withRoutes(t, proxy.Route{Host: "probe.test", Address: "127.0.0.1", Port: port,
+		BreakerFailures: 2, BreakerOpenTime: 200})()
+	get := func(path string, codes chan<- int) {
+		_, _, code, err := httpGet("http://probe.test"+path, testProxy)
+		assert.NilError(t, err)
+		codes <- code
+	}
+
+	late, probe, codes := make(chan int, 1), make(chan int, 1), make(chan int, 1)
+	go get("/slow-ok", late) // allowed while closed, answered while half-open
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		get("/fail", codes)
+		assert.Equal(t, <-codes, 500)
+	}
+	time.Sleep(250 * time.Millisecond)
+	go get("/slow-fail", probe)
+	time.Sleep(50 * time.Millisecond)
+	get("/", codes)
+	assert.Equal(t, <-codes, 503, "a single probe passes while half-open")
+
+	assert.Equal(t, <-late, 200)
+	get("/", codes)
+	assert.Equal(t, <-codes, 503, "late success of a request allowed while closed does not close the breaker")
+	assert.Equal(t, <-probe, 500)
+	assert.Equal(t, metricValue(t, `udsproxy_circuit_breaker_state{upstream="127.0.0.1:`+strconv.Itoa(port)+`"}`), "2",
+		"failed probe opens the breaker again")
+}
+
+func Test_ReloadSwapsRoutesAtomically(t *testing.T) {
+	settings := proxy.Settings{SocketPath: "uds-proxy-reload.sock", ClientTimeout: 1000,
+		Routes: []proxy.Route{{Host: "before.test", Address: "localhost", Port: 25777}}}
+	reloadingProxy := proxy.NewProxyInstance(settings)
+	go reloadingProxy.Run()
+	defer reloadingProxy.Shutdown(nil)
+	time.Sleep(250 * time.Millisecond)
+
+	// a slow request started before the reload must complete on the old configuration
+	slowResponseCode := make(chan int)
+	go func() {
+		_, _, code, _ := httpGet("http://before.test/slow/200/500", reloadingProxy)
+		slowResponseCode <- code
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	reloadingProxy.ConfigLoader = func() (proxy.Settings, error) {
+		settings.Routes = []proxy.Route{{Host: "after.test", Address: "localhost", Port: 25777}}
+		return settings, nil
+	}
+	assert.NilError(t, reloadingProxy.Reload())
+
+	_, _, responseCode, err := httpGet("http://after.test/", reloadingProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200)
+	_, _, responseCode, err = httpGet("http://before.test/", reloadingProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, http.StatusMisdirectedRequest)
+	assert.Equal(t, <-slowResponseCode, 200)
+	assert.Equal(t, reloadingProxy.CurrentOptions().Routes[0].Host, "after.test")
+	assert.Equal(t, reloadingProxy.Options.Routes[0].Host, "before.test", "Options are the startup configuration")
+	assert.Assert(t, reloadingProxy.CurrentHTTPClient() != reloadingProxy.HTTPClient, "clients are swapped")
+
+	reloadingProxy.ConfigLoader = func() (proxy.Settings, error) {
+		settings.Routes = []proxy.Route{{Host: "~("}}
+		return settings, nil
+	}
+	assert.ErrorContains(t, reloadingProxy.Reload(), "routes[0]: host: invalid host regex")
+	_, _, responseCode, err = httpGet("http://after.test/", reloadingProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, responseCode, 200, "failed reload keeps previous configuration")
+}
+
+func Test_ShutdownDrainsInflightRequests(t *testing.T) {
+	drainingProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: "uds-proxy-drain.sock",
+		ClientTimeout: 1000, ShutdownTimeout: 1000})
+	runResult := make(chan error)
+	go func() { runResult <- drainingProxy.Run() }()
+	time.Sleep(250 * time.Millisecond)
+
+	responseCode := make(chan int)
+	go func() {
+		_, _, code, _ := httpGet(fakeServerBaseURL+"/slow/200/500", drainingProxy)
+		responseCode <- code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	drainingProxy.Shutdown(nil)
+
+	assert.Equal(t, <-responseCode, 200, "request in flight completes")
+	assert.NilError(t, <-runResult)
+	_, err := net.Dial("unix", drainingProxy.Options.SocketPath)
+	assert.Assert(t, err != nil, "socket is gone after shutdown")
+}
+
+func Test_SocketPermissionsAreApplied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uds-proxy-socket")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "run", "uds-proxy.sock")
+	permissionProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: socket, SocketMode: "0640",
+		SocketGroup: strconv.Itoa(os.Getgid()), SocketCreateDir: true})
+	go permissionProxy.Run()
+	defer permissionProxy.Shutdown(nil)
+
+	waitFor(t, "socket to be created", func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	})
+	info, err := os.Stat(socket)
+	assert.NilError(t, err)
+	assert.Equal(t, info.Mode()&os.ModeType, os.ModeSocket)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0640))
+	assert.Equal(t, int(info.Sys().(*syscall.Stat_t).Gid), os.Getgid())
+	_, _, code, err := httpGet(fakeServerBaseURL+"/", permissionProxy)
+	assert.NilError(t, err)
+	assert.Equal(t, code, 200)
+}
+
+func Test_SocketPathTypes(t *testing.T) {
+	for _, test := range []struct {
+		name, socket string
+	}{
+		{"filesystem", "uds-proxy-path-types.sock"},
+		{"abstract", fmt.Sprintf("@uds-proxy-path-types-%d", os.Getpid())},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.name == "filesystem" {
+				// a stale socket file is replaced
+				assert.NilError(t, ioutil.WriteFile(test.socket, nil, 0600))
+			}
+			pathProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: test.socket, ClientTimeout: 1000})
+			go pathProxy.Run()
+			time.Sleep(250 * time.Millisecond)
+
+			body, _, code, err := httpGet(fakeServerBaseURL+"/", pathProxy)
+			assert.NilError(t, err)
+			assert.Equal(t, code, 200)
+			assert.Equal(t, string(body), "ROOT-INDEX-OK")
+			info, err := os.Stat(test.socket)
+			if test.name == "filesystem" {
+				assert.NilError(t, err)
+				assert.Equal(t, info.Mode()&os.ModeType, os.ModeSocket)
+			} else {
+				assert.Assert(t, os.IsNotExist(err), "abstract socket has no file")
+			}
+
+			pathProxy.Shutdown(nil)
+			_, err = os.Stat(test.socket)
+			assert.Assert(t, os.IsNotExist(err), "no file is left at %s", test.socket)
+			_, err = net.Dial("unix", test.socket)
+			assert.Assert(t, err != nil, "socket is gone after shutdown")
+		})
+	}
+}
+
+func Test_ShutdownAbortsRequestsAfterTimeout(t *testing.T) {
+	drainingProxy := proxy.NewProxyInstance(proxy.Settings{SocketPath: "uds-proxy-abort.sock",
+		ClientTimeout: 1000, ShutdownTimeout: 200})
+	go drainingProxy.Run()
+	time.Sleep(250 * time.Millisecond)
+
+	requestErr := make(chan error)
+	go func() {
+		_, _, _, err := httpGet(fakeServerBaseURL+"/slow/200/900", drainingProxy)
+		requestErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	drainingProxy.Shutdown(nil)
+
+	assert.Assert(t, time.Since(start) < 500*time.Millisecond, "shutdown must not wait beyond its timeout")
+	assert.Assert(t, <-requestErr != nil, "request in flight is aborted")
+}
+
+func Test_UpgradeHandsOverSocketWithoutFailedRequests(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("uds-proxy refuses to run as root")
+	}
+	dir, err := ioutil.TempDir("", "uds-proxy-upgrade")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildProxyBinary(t, dir)
+	socket := filepath.Join(dir, "upgrade.sock")
+	pidFile := filepath.Join(dir, "upgrade.pid")
+	oldProcess := exec.Command(binary, "-socket", socket, "-pid-file", pidFile, "-no-access-log")
+	oldProcess.Stderr = os.Stderr
+	assert.NilError(t, oldProcess.Start())
+	waitFor(t, "old process to write its pid file", func() bool { return readPidFile(pidFile) == oldProcess.Process.Pid })
+
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	var requests, failures int64
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			requests++
+			response, err := client.Get(fakeServerBaseURL + "/")
+			if err != nil {
+				failures++
+				t.Logf("request failed during upgrade: %s", err)
+				continue
+			}
+			ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			if response.StatusCode != 200 {
+				failures++
+			}
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	assert.NilError(t, oldProcess.Process.Signal(syscall.SIGUSR2))
+	exited := make(chan error)
+	go func() { exited <- oldProcess.Wait() }()
+	select {
+	case err = <-exited:
+		assert.NilError(t, err, "old process exits cleanly after draining")
+	case <-time.After(10 * time.Second):
+		t.Fatal("old process did not exit after handing over")
+	}
+	newPid := readPidFile(pidFile)
+	assert.Assert(t, newPid != 0 && newPid != oldProcess.Process.Pid, "pid file names new process")
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	<-stopped
+
+	assert.Equal(t, failures, int64(0))
+	assert.Assert(t, requests > 10)
+	assert.NilError(t, syscall.Kill(newPid, syscall.SIGTERM))
+	waitFor(t, "new process to remove socket", func() bool {
+		_, err := os.Stat(socket)
+		return os.IsNotExist(err)
+	})
+}
+
+func Test_SocketActivationAndNotifications(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("uds-proxy refuses to run as root")
+	}
+	dir, err := ioutil.TempDir("", "uds-proxy-systemd")
+	assert.NilError(t, err)
+	defer os.RemoveAll(dir)
+	binary := buildProxyBinary(t, dir)
+
+	// play systemd: own the socket and receive notifications
+	socket := filepath.Join(dir, "activated.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	assert.NilError(t, err)
+	listener.SetUnlinkOnClose(false)
+	listenerFile, err := listener.File()
+	assert.NilError(t, err)
+	listener.Close()
+	notifySocket := filepath.Join(dir, "notify.sock")
+	notifications, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+	assert.NilError(t, err)
+	defer notifications.Close()
+	nextNotification := func() string {
+		buf := make([]byte, 1024)
+		notifications.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := notifications.Read(buf)
+		assert.NilError(t, err)
+		return string(buf[:n])
+	}
+
+	// LISTEN_PID must name the proxy process itself, which only the shell knows before exec
+	process := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`, binary, "-socket", socket, "-no-access-log")
+	process.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=uds-proxy.socket",
+		"NOTIFY_SOCKET="+notifySocket, "WATCHDOG_USEC=100000")
+	process.ExtraFiles = []*os.File{listenerFile}
+	process.Stderr = os.Stderr
+	assert.NilError(t, process.Start())
+	listenerFile.Close()
+	defer process.Process.Kill()
+
+	assert.Equal(t, nextNotification(), "READY=1")
+	assert.Equal(t, nextNotification(), "WATCHDOG=1")
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+	response, err := client.Get(fakeServerBaseURL + "/")
+	assert.NilError(t, err)
+	response.Body.Close()
+	assert.Equal(t, response.StatusCode, 200)
+
+	assert.NilError(t, process.Process.Signal(syscall.SIGTERM))
+	for notification := nextNotification(); notification != "STOPPING=1"; notification = nextNotification() {
+		assert.Equal(t, notification, "WATCHDOG=1")
+	}
+	assert.NilError(t, process.Wait())
+	_, err = os.Stat(socket)
+	assert.NilError(t, err, "socket file owned by systemd is kept")
+}
+
 // MultipleBlockingCallsDoNotBlockSocket -- 10 x go curl /slow/no-response/65000
 // TimeoutRespectedAndReportedCorrectly
 // PostDataIsPreserved
@@ -125,16 +1315,23 @@ func Test_ProxyPreservesResponseHeaders(t *testing.T) {
 // TestMetricsReportCorrectNumberOfRequests
 // check behaviour with sticky/slow client ie sock read timeout etc
 
-func httpGet(url string, proxyInstance *proxy.Instance) (body []byte, header http.Header, responseCode int, err error) {
-	client := http.Client{}
-	if proxyInstance != nil {
-		client.Transport = &http.Transport{
-			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-				return net.Dial("unix", proxyInstance.Options.SocketPath)
-			},
-		}
+func udsClient(proxyInstance *proxy.Instance) *http.Client {
+	if proxyInstance == nil {
+		return &http.Client{}
 	}
-	response, err := client.Get(url)
+	return socketClient(proxyInstance.Options.SocketPath)
+}
+
+func socketClient(socket string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}}
+}
+
+func httpGet(url string, proxyInstance *proxy.Instance) (body []byte, header http.Header, responseCode int, err error) {
+	response, err := udsClient(proxyInstance).Get(url)
 	if err != nil {
 		return
 	}
@@ -144,6 +1341,183 @@ func httpGet(url string, proxyInstance *proxy.Instance) (body []byte, header htt
 	return
 }
 
+// connect sends a CONNECT request for authority to proxyInstance and returns the response status.
+func connect(t *testing.T, proxyInstance *proxy.Instance, authority string) int {
+	conn, err := net.Dial("unix", proxyInstance.Options.SocketPath)
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", authority, authority)
+	assert.NilError(t, err)
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	assert.NilError(t, err)
+	return response.StatusCode
+}
+
+// withRoutes reloads testProxy with routes, followed by a catch-all route for the hosts of other tests.
+// The returned function restores the test proxy's configuration.
+func withRoutes(t *testing.T, routes ...proxy.Route) (restore func()) {
+	t.Helper()
+	return withSettings(t, testProxy.Options, routes...)
+}
+
+// withSettings is like withRoutes, but reloads testProxy with settings instead of its options.
+func withSettings(t *testing.T, settings proxy.Settings, routes ...proxy.Route) (restore func()) {
+	t.Helper()
+	settings.Routes = append(append([]proxy.Route(nil), routes...), proxy.Route{Host: "*"})
+	testProxy.ConfigLoader = func() (proxy.Settings, error) {
+		return settings, nil
+	}
+	assert.NilError(t, testProxy.Reload())
+	return func() {
+		testProxy.ConfigLoader = nil
+		assert.NilError(t, testProxy.Reload(), "test proxy configuration must be restored")
+	}
+}
+
+// upstreamPort returns the port a test server listens on.
+func upstreamPort(server *httptest.Server) int {
+	return server.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// metricValue returns the value testProxy exports for series, i.e. a metric name with its labels, or
+// "" if there is no such series.
+func metricValue(t *testing.T, series string) string {
+	t.Helper()
+	metrics, _, _, err := httpGet(metricsURL, nil)
+	assert.NilError(t, err)
+	for _, line := range strings.Split(string(metrics), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+	return ""
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for deadline := time.Now().Add(10 * time.Second); !condition(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// runFakeDNSServer answers A queries for the names in records (with a TTL of one second), AAAA
+// queries with no records and others with NXDOMAIN -- or all of them with SERVFAIL while failing
+// is set. It returns its address and the number of queries received.
+func runFakeDNSServer(t *testing.T, records map[string]string, failing *int32) (string, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	queries := new(int32)
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buffer[:n]) != nil || len(query.Questions) != 1 {
+				continue
+			}
+			atomic.AddInt32(queries, 1)
+			question := query.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			address, known := records[question.Name.String()]
+			switch {
+			case atomic.LoadInt32(failing) != 0:
+				response.RCode = dnsmessage.RCodeServerFailure
+			case !known:
+				response.RCode = dnsmessage.RCodeNameError
+			case question.Type == dnsmessage.TypeA:
+				var a [4]byte
+				copy(a[:], net.ParseIP(address).To4())
+				response.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA,
+						Class: dnsmessage.ClassINET, TTL: 1},
+					Body: &dnsmessage.AResource{A: a},
+				}}
+			}
+			packed, _ := response.Pack()
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), queries
+}
+
+// buildProxyBinary builds the uds-proxy command into dir, for tests that need separate processes.
+func buildProxyBinary(t *testing.T, dir string) string {
+	binary := filepath.Join(dir, "uds-proxy")
+	build := exec.Command("go", "build", "-o", binary, "github.com/schnoddelbotz/uds-proxy/cmd/uds-proxy")
+	build.Stderr = os.Stderr
+	assert.NilError(t, build.Run())
+	return binary
+}
+
+func readPidFile(path string) int {
+	data, _ := ioutil.ReadFile(path)
+	pid, _ := strconv.Atoi(string(data))
+	return pid
+}
+
+// testCertificate is a certificate and key generated for tests.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate for commonName valid for validity, signed by ca or,
+// if nil, self-signed as CA.
+func newTestCertificate(t *testing.T, commonName string, validity time.Duration, ca *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.certificate, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.NilError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+// write stores the PEM encoded certificate and, unless keyFile is empty, its key.
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw})
+	assert.NilError(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		assert.NilError(t, err)
+		assert.NilError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func (c *testCertificate) keyPair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key, Leaf: c.certificate}
+}
+
+func (c *testCertificate) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.certificate)
+	return pool
+}
+
 func newTestProxyInstance() *proxy.Instance {
 	args := proxy.Settings{
 		SocketPath:      "uds-proxy-functional_test.sock",
@@ -151,6 +1525,9 @@ func newTestProxyInstance() *proxy.Instance {
 		PrometheusPort:  metricsPort,
 		NoLogTimeStamps: true,
 		ClientTimeout:   1000,
+		ConnectPorts:    fakeServerPort[1:],
+		MetricsPeerUID:  true,
+		SocketH2C:       true,
 	}
 	e := proxy.NewProxyInstance(args)
 	go e.Run()
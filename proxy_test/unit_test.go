@@ -3,6 +3,12 @@
 package proxy_test
 
 import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"testing"
 	"time"
 
@@ -36,12 +42,185 @@ func Test_EnvArgumentRemoteHTTPSArrivesInOptions(t *testing.T) {
 	e.Shutdown(nil)
 }
 
+func Test_ConnectPortsAreValidated(t *testing.T) {
+	s := proxy.DefaultSettings()
+	s.SocketPath = testSocketFilename
+	for _, ports := range []string{"", "443", " 443 , 8443 ", "443,,8443,", "1,65535"} {
+		s.ConnectPorts = ports
+		assert.NoError(t, s.Validate(), ports)
+	}
+	for ports, invalid := range map[string]string{"443,https": "https", "0": "0", "65536": "65536", "-443": "-443",
+		"443 8443": "443 8443", "443;8443": "443;8443"} {
+		s.ConnectPorts = ports
+		assert.EqualError(t, s.Validate(), fmt.Sprintf("connect-ports: invalid port %q", invalid), ports)
+	}
+}
+
+func Test_ConnectToPortNotAllowedIsForbidden(t *testing.T) {
+	e := proxy.NewProxyInstance(proxy.Settings{SocketPath: testSocketFilename, ClientTimeout: 1000,
+		ConnectPorts: " 25998 ,, 443 "})
+	go e.Run()
+	defer e.Shutdown(nil)
+	connect := func(authority string) int {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ { // until the socket is up
+			if conn, err = net.Dial("unix", testSocketFilename); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", authority, authority)
+		response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		assert.NoError(t, err)
+		return response.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, connect("127.0.0.1:25999"))
+	assert.Equal(t, http.StatusForbidden, connect("127.0.0.1:8443"))
+	assert.Equal(t, http.StatusBadGateway, connect("127.0.0.1:25998"), "allowed port is dialled")
+}
+
+func Test_RoutesFileIsLoaded(t *testing.T) {
+	routesFile := writeTempFile(t, "uds-proxy-routes-*.json", `{"routes": [{"host": "*.example.com", "scheme": "https", "client-timeout": 250}]}`)
+	defer os.Remove(routesFile)
+
+	e := proxy.NewProxyInstance(proxy.Settings{SocketPath: testSocketFilename, RoutesFile: routesFile})
+
+	assert.Equal(t, []proxy.Route{{Host: "*.example.com", Scheme: "https", ClientTimeout: 250}}, e.Options.Routes)
+	e.Shutdown(nil)
+}
+
+func Test_LoadSettingsPrecedence(t *testing.T) {
+	configFile := writeTempFile(t, "uds-proxy-*.yaml", "socket: from-file.sock\nclient-timeout: 1111\nmax-idle-conns: 7\nremote-https: true\n")
+	defer os.Remove(configFile)
+	os.Setenv("UDS_PROXY_CLIENT_TIMEOUT", "2222")
+	os.Setenv("UDS_PROXY_SOCKET", "from-env.sock")
+	defer os.Unsetenv("UDS_PROXY_CLIENT_TIMEOUT")
+	defer os.Unsetenv("UDS_PROXY_SOCKET")
+
+	s, err := proxy.LoadSettings(configFile, map[string]string{"socket": "from-flag.sock"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "from-flag.sock", s.SocketPath, "flags override env")
+	assert.Equal(t, 2222, s.ClientTimeout, "env overrides file")
+	assert.Equal(t, 7, s.MaxIdleConns, "file overrides defaults")
+	assert.True(t, s.RemoteHTTPS)
+	assert.Equal(t, proxy.DefaultSettings().MaxConnsPerHost, s.MaxConnsPerHost, "defaults apply")
+}
+
+func Test_LoadSettingsSupportsJSONAndTOML(t *testing.T) {
+	jsonFile := writeTempFile(t, "uds-proxy-*.json", `{"socket": "json.sock", "routes": [{"host": "a.test", "port": 8080}]}`)
+	defer os.Remove(jsonFile)
+	tomlFile := writeTempFile(t, "uds-proxy-*.toml", "socket = \"toml.sock\"\n[[routes]]\nhost = \"a.test\"\nport = 8080\n")
+	defer os.Remove(tomlFile)
+
+	for _, file := range []string{jsonFile, tomlFile} {
+		s, err := proxy.LoadSettings(file, nil)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []proxy.Route{{Host: "a.test", Port: 8080}}, s.Routes)
+	}
+}
+
+func Test_LoadSettingsRejectsInvalidInput(t *testing.T) {
+	unknownKey := writeTempFile(t, "uds-proxy-*.yaml", "sockett: typo.sock\n")
+	defer os.Remove(unknownKey)
+
+	_, err := proxy.LoadSettings(unknownKey, nil)
+	assert.Contains(t, err.Error(), `unknown field "sockett"`)
+
+	_, err = proxy.LoadSettings("", map[string]string{"client-timeout": "soon"})
+	assert.EqualError(t, err, `-client-timeout: invalid integer "soon"`)
+}
+
+func Test_ValidateReportsOffendingOption(t *testing.T) {
+	s := proxy.DefaultSettings()
+	assert.EqualError(t, s.Validate(), "socket: a socket path must be provided (-socket, UDS_PROXY_SOCKET or config file)")
+
+	s.SocketPath = testSocketFilename
+	s.MaxIdleConns = -1
+	assert.EqualError(t, s.Validate(), "max-idle-conns: must not be negative, got -1")
+
+	s.MaxIdleConns = 0
+	s.SocketMode = "0999"
+	assert.EqualError(t, s.Validate(), "socket-mode: invalid mode \"0999\", expected octal permissions like 0660")
+
+	s.SocketMode = "0660"
+	s.Routes = []proxy.Route{{Host: "ok.test"}, {Host: "~(", Scheme: "https"}}
+	assert.EqualError(t, s.Validate(), "routes[1]: host: invalid host regex \"(\": error parsing regexp: missing closing ): `(`")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", TLSCert: "client.pem"}}
+	assert.EqualError(t, s.Validate(), "routes[0]: tls-key: must be set along with tls-cert")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", TLSMinVersion: "1.4"}}
+	assert.EqualError(t, s.Validate(), "routes[0]: tls-min-version: invalid version \"1.4\", expected 1.0, 1.1, 1.2 or 1.3")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", UpstreamProtocol: "h3"}}
+	assert.EqualError(t, s.Validate(), "routes[0]: upstream-protocol: must be http1, h2 or h2c, got \"h3\"")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", Retries: -2}}
+	assert.EqualError(t, s.Validate(), "routes[0]: retries: must not be negative, got -2")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", ConcurrencyMode: "random"}}
+	assert.EqualError(t, s.Validate(), `routes[0]: concurrency-mode: must be fixed, aimd or gradient, got "random"`)
+
+	s.Routes = []proxy.Route{{Host: "ok.test", RateLimit: "10/d"}}
+	assert.EqualError(t, s.Validate(), `routes[0]: rate-limit: invalid rate "10/d", expected requests per second, minute or hour, e.g. 10/s or 600/m`)
+
+	s.Routes = []proxy.Route{{Host: "ok.test", HedgeBudget: -5}}
+	assert.EqualError(t, s.Validate(), "routes[0]: hedge-budget: must be within 0-100, got -5")
+
+	s.Routes = []proxy.Route{{Host: "ok.test", BreakerErrorRate: 150}}
+	assert.EqualError(t, s.Validate(), "routes[0]: breaker-error-rate: must be within 0-100, got 150")
+
+	s.Routes = nil
+	s.TLSCipherSuites = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_NO_SUCH_CIPHER"
+	assert.EqualError(t, s.Validate(), "tls-cipher-suites: unknown cipher suite \"TLS_NO_SUCH_CIPHER\"")
+
+	s.TLSCipherSuites = ""
+	s.DNSServers = "10.0.0.2, resolver.internal:53"
+	assert.EqualError(t, s.Validate(), "dns-servers: \"resolver.internal:53\" is not an IP address")
+
+	s.DNSServers = ""
+	s.HostOverrides = map[string]string{"api.example.com": "10.0.0.5:http"}
+	assert.EqualError(t, s.Validate(), "host-overrides: \"api.example.com\": invalid address \"10.0.0.5:http\", expected host or host:port")
+
+	s.HostOverrides = nil
+	s.ListenTCP = "0.0.0.0:3128"
+	assert.EqualError(t, s.Validate(), "listen-tcp: 0.0.0.0 is not a loopback address")
+
+	s.ListenTCP = "localhost:3128"
+	s.Listeners = []proxy.Listener{{Name: "other", Socket: "other.sock"}, {Socket: testSocketFilename}}
+	assert.EqualError(t, s.Validate(), "listeners[1]: socket: "+testSocketFilename+" is used twice")
+}
+
 func Test_AppVersionDefined(t *testing.T) {
 	assert.NotEqual(t, proxy.AppVersion, "0.0.0-dev")
 }
 
-func Test_PanicsIfDirectoryProvidedAsFilenameForSocket(t *testing.T) {
+func Test_RunFailsIfDirectoryProvidedAsFilenameForSocket(t *testing.T) {
 	e := proxy.NewProxyInstance(proxy.Settings{SocketPath: "/tmp"})
 
-	assert.Panics(t, e.Run, "-socket must be a filename, panics if  undeleteable")
+	assert.Error(t, e.Run(), "-socket must be a filename, Run fails if undeleteable")
+}
+
+func Test_RunFailsIfSocketGroupCannotBeApplied(t *testing.T) {
+	e := proxy.NewProxyInstance(proxy.Settings{SocketPath: testSocketFilename, SocketGroup: "uds-proxy-no-such-group"})
+
+	err := e.Run()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "socket-group: ")
+	_, err = os.Stat(testSocketFilename)
+	assert.True(t, os.IsNotExist(err), "no socket is left behind")
+}
+
+func writeTempFile(t *testing.T, pattern, content string) string {
+	f, err := ioutil.TempFile("", pattern)
+	assert.Nil(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
 }
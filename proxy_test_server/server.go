@@ -1,6 +1,7 @@
 package proxy_test_server
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -63,6 +64,59 @@ func RunUpstreamFakeServer(port string, fork bool) *http.Server {
 		io.Copy(w, io.LimitReader(NewRandomReaderWithSizeLimit(size), int64(size)))
 	})
 
+	http.HandleFunc("/headers/repeated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/")
+		w.Header().Add("Set-Cookie", "theme=dark; Path=/")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Set("Connection", "X-Hop-Only")
+		w.Header().Set("X-Hop-Only", "must-not-be-forwarded")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		io.WriteString(w, "REPEATED-HEADERS-OK")
+	})
+
+	http.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "TRAILERS-OK")
+		w.Header().Set("X-Checksum", "c0ffee")
+		w.Header().Set(http.TrailerPrefix+"X-Unannounced", "surprise")
+	})
+
+	http.HandleFunc("/stream/", func(w http.ResponseWriter, r *http.Request) {
+		params := strings.Split(strings.Replace(r.URL.Path, "/stream/", "", 1), "/")
+		if len(params) < 2 {
+			http.Error(w, "Bad usage", http.StatusBadRequest)
+			return
+		}
+		count, _ := strconv.Atoi(params[0])
+		delay, _ := strconv.Atoi(params[1])
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "data: event-%d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Duration(delay) * time.Millisecond)
+		}
+	})
+
+	http.HandleFunc("/upgrade/echo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "Upgrade: echo required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	})
+
+	http.HandleFunc("/echo/host", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})
+
 	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "Fakeserver says ciao!")
 		go func() {